@@ -0,0 +1,132 @@
+package sftpd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// activity tracks the sftp requests and open handles of the channels
+// of a connection served by a Config. A nil activity tracks nothing.
+type activity struct {
+	mu sync.Mutex
+	// requests counts the requests being served, last is the time
+	// a request was last received or answered.
+	requests int
+	last     time.Time
+	// sessions contains the handles of the channels being served.
+	sessions map[*handles]struct{}
+}
+
+func newActivity() *activity {
+	return &activity{last: time.Now(), sessions: map[*handles]struct{}{}}
+}
+
+func withActivity(ctx context.Context, a *activity) context.Context {
+	return context.WithValue(ctx, activityKey, a)
+}
+
+func activityFromContext(ctx context.Context) *activity {
+	a, _ := ctx.Value(activityKey).(*activity)
+	return a
+}
+
+func (a *activity) addSession(h *handles) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.sessions[h] = struct{}{}
+	a.mu.Unlock()
+}
+
+func (a *activity) removeSession(h *handles) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	delete(a.sessions, h)
+	a.mu.Unlock()
+}
+
+// begin is called when a request has been received and end when
+// it has been answered.
+func (a *activity) begin() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.requests++
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *activity) end() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.requests--
+	a.last = time.Now()
+	a.mu.Unlock()
+}
+
+// busy reports whether requests are in flight or handles are open.
+func (a *activity) busy() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.requests > 0 {
+		return true
+	}
+	for h := range a.sessions {
+		if h.count() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// closeHandles closes the open handles of all channels, which ends
+// requests blocked in them.
+func (a *activity) closeHandles() {
+	a.mu.Lock()
+	hs := make([]*handles, 0, len(a.sessions))
+	for h := range a.sessions {
+		hs = append(hs, h)
+	}
+	a.mu.Unlock()
+	for _, h := range hs {
+		h.closeAll()
+	}
+}
+
+// idleFor returns how long no request has been in flight.
+func (a *activity) idleFor() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.requests > 0 {
+		return 0
+	}
+	return time.Since(a.last)
+}
+
+// watchIdle closes conn once no request has been in flight for
+// timeout, or returns when done is closed.
+func (a *activity) watchIdle(timeout time.Duration, conn io.Closer, done <-chan struct{}) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		d := a.idleFor()
+		if d >= timeout {
+			conn.Close()
+			return
+		}
+		t.Reset(timeout - d)
+	}
+}
@@ -0,0 +1,245 @@
+package sftpd
+
+import (
+	"os"
+	"time"
+
+	"github.com/taruti/binp"
+)
+
+// attrFlags3 contains the attribute flags of protocol version 3.
+const attrFlags3 = ssh_FILEXFER_ATTR_SIZE | ssh_FILEXFER_ATTR_UIDGID | ssh_FILEXFER_ATTR_PERMISSIONS |
+	ssh_FILEXFER_ATTR_ACMODTIME | ssh_FILEXFER_ATTR_EXTENDED
+
+func (s *session) parseAttr(p *binp.Parser, a *Attr) *binp.Parser {
+	if s.version < 4 {
+		return parseAttr(p, a)
+	}
+	return parseAttr4(p, a, s.version)
+}
+
+func (s *session) outAttr(o *binp.Printer, a *Attr) {
+	if s.version < 4 {
+		outAttr3(o, a)
+		return
+	}
+	outAttr4(o, a, s.version, s.opts.NameResolver)
+}
+
+// parseStatFlags parses the flags field of stat requests in protocol
+// version 4 and later. The flags are only a hint and are ignored.
+func (s *session) parseStatFlags(p *binp.Parser) *binp.Parser {
+	if s.version < 4 {
+		return p
+	}
+	var flags uint32
+	return p.B32(&flags)
+}
+
+// parseAttr4 parses attributes of protocol version 4 and later.
+func parseAttr4(p *binp.Parser, a *Attr, version uint32) *binp.Parser {
+	var flags uint32
+	var typ []byte
+	p = p.B32(&flags).NBytesPeek(1, &typ)
+	if p == nil {
+		return nil
+	}
+	var ignoredTime time.Time
+	var ignored64 uint64
+	var ignored32 uint32
+	var ignoredString string
+	var ignoredBytes []byte
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		p = p.B64(&a.Size)
+		a.Flags |= ATTR_SIZE
+	}
+	if version >= 6 && flags&ssh_FILEXFER_ATTR_ALLOCATION_SIZE != 0 {
+		p = p.B64(&ignored64)
+	}
+	if flags&ssh_FILEXFER_ATTR_OWNERGROUP != 0 {
+		p = p.B32String(&a.User).B32String(&a.Group)
+		a.Flags |= ATTR_OWNERGROUP
+	}
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var mode uint32
+		p = p.B32(&mode)
+		a.Mode = sftpToFileMode(mode)&os.ModePerm | typeToFileMode(typ[0])
+		a.Flags |= ATTR_MODE
+	}
+	if flags&ssh_FILEXFER_ATTR_ACCESSTIME != 0 {
+		p = inTime4(p, flags, &a.ATime)
+		a.Flags |= ATTR_TIME
+	}
+	if flags&ssh_FILEXFER_ATTR_CREATETIME != 0 {
+		p = inTime4(p, flags, &a.CreateTime)
+		a.Flags |= ATTR_CREATETIME
+	}
+	if flags&ssh_FILEXFER_ATTR_MODIFYTIME != 0 {
+		p = inTime4(p, flags, &a.MTime)
+		a.Flags |= ATTR_TIME
+	}
+	if version >= 6 && flags&ssh_FILEXFER_ATTR_CTIME != 0 {
+		p = inTime4(p, flags, &ignoredTime)
+	}
+	if flags&ssh_FILEXFER_ATTR_ACL != 0 {
+		// ACLs are not supported and ignored.
+		p = p.B32String(&ignoredString)
+	}
+	if version >= 5 && flags&ssh_FILEXFER_ATTR_BITS != 0 {
+		p = p.B32(&a.AttribBits)
+		a.AttribBitsValid = 0xFFFFFFFF
+		if version >= 6 {
+			p = p.B32(&a.AttribBitsValid)
+		}
+		a.AttribBits &= a.AttribBitsValid
+		a.Flags |= ATTR_BITS
+	}
+	if version >= 6 {
+		if flags&ssh_FILEXFER_ATTR_TEXT_HINT != 0 {
+			p = p.NBytesPeek(1, &ignoredBytes)
+		}
+		if flags&ssh_FILEXFER_ATTR_MIME_TYPE != 0 {
+			p = p.B32String(&ignoredString)
+		}
+		if flags&ssh_FILEXFER_ATTR_LINK_COUNT != 0 {
+			p = p.B32(&ignored32)
+		}
+		if flags&ssh_FILEXFER_ATTR_UNTRANSLATED_NAME != 0 {
+			p = p.B32String(&ignoredString)
+		}
+	}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		p = parseExtended(p, a)
+		a.Flags |= ssh_FILEXFER_ATTR_EXTENDED
+	}
+	return p
+}
+
+// outAttr4 writes attributes of protocol version 4 and later.
+func outAttr4(o *binp.Printer, a *Attr, version uint32, r NameResolver) {
+	var flags uint32
+	if a.Flags&ATTR_SIZE != 0 {
+		flags |= ssh_FILEXFER_ATTR_SIZE
+	}
+	if a.Flags&(ATTR_UIDGID|ATTR_OWNERGROUP) != 0 {
+		flags |= ssh_FILEXFER_ATTR_OWNERGROUP
+	}
+	if a.Flags&ATTR_MODE != 0 {
+		flags |= ssh_FILEXFER_ATTR_PERMISSIONS
+	}
+	if a.Flags&ATTR_TIME != 0 && !a.ATime.IsZero() {
+		flags |= ssh_FILEXFER_ATTR_ACCESSTIME | ssh_FILEXFER_ATTR_SUBSECOND_TIMES
+	}
+	if a.Flags&ATTR_CREATETIME != 0 && !a.CreateTime.IsZero() {
+		flags |= ssh_FILEXFER_ATTR_CREATETIME | ssh_FILEXFER_ATTR_SUBSECOND_TIMES
+	}
+	if a.Flags&ATTR_TIME != 0 && !a.MTime.IsZero() {
+		flags |= ssh_FILEXFER_ATTR_MODIFYTIME | ssh_FILEXFER_ATTR_SUBSECOND_TIMES
+	}
+	if version >= 5 && a.Flags&ATTR_BITS != 0 {
+		flags |= ssh_FILEXFER_ATTR_BITS
+	}
+	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		flags |= ssh_FILEXFER_ATTR_EXTENDED
+	}
+	var typ byte = ssh_FILEXFER_TYPE_UNKNOWN
+	if a.Flags&ATTR_MODE != 0 {
+		typ = fileModeToType(a.Mode, version)
+	}
+	o.B32(flags).Byte(typ)
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
+	}
+	if flags&ssh_FILEXFER_ATTR_OWNERGROUP != 0 {
+		user, group := a.User, a.Group
+		if a.Flags&ATTR_UIDGID != 0 {
+			if user == "" {
+				user = idName(r.UserName(a.Uid), a.Uid)
+			}
+			if group == "" {
+				group = idName(r.GroupName(a.Gid), a.Gid)
+			}
+		}
+		o.B32String(user).B32String(group)
+	}
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
+	}
+	if flags&ssh_FILEXFER_ATTR_ACCESSTIME != 0 {
+		outTime4(o, a.ATime)
+	}
+	if flags&ssh_FILEXFER_ATTR_CREATETIME != 0 {
+		outTime4(o, a.CreateTime)
+	}
+	if flags&ssh_FILEXFER_ATTR_MODIFYTIME != 0 {
+		outTime4(o, a.MTime)
+	}
+	if flags&ssh_FILEXFER_ATTR_BITS != 0 {
+		if version >= 6 {
+			o.B32(a.AttribBits & a.AttribBitsValid).B32(a.AttribBitsValid)
+		} else {
+			o.B32(a.AttribBits & a.AttribBitsValid)
+		}
+	}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func inTime4(p *binp.Parser, flags uint32, t *time.Time) *binp.Parser {
+	var sec uint64
+	var nsec uint32
+	p = p.B64(&sec)
+	if flags&ssh_FILEXFER_ATTR_SUBSECOND_TIMES != 0 {
+		p = p.B32(&nsec)
+	}
+	if p != nil {
+		*t = time.Unix(int64(sec), int64(nsec))
+	}
+	return p
+}
+
+// outTime4 writes a time with the SSH_FILEXFER_ATTR_SUBSECOND_TIMES flag set.
+func outTime4(o *binp.Printer, t time.Time) {
+	o.B64(uint64(t.Unix())).B32(uint32(t.Nanosecond()))
+}
+
+func fileModeToType(m os.FileMode, version uint32) byte {
+	switch {
+	case m.IsRegular():
+		return ssh_FILEXFER_TYPE_REGULAR
+	case m.IsDir():
+		return ssh_FILEXFER_TYPE_DIRECTORY
+	case m&os.ModeSymlink != 0:
+		return ssh_FILEXFER_TYPE_SYMLINK
+	case version < 5:
+		return ssh_FILEXFER_TYPE_SPECIAL
+	case m&os.ModeSocket != 0:
+		return ssh_FILEXFER_TYPE_SOCKET
+	case m&os.ModeCharDevice != 0:
+		return ssh_FILEXFER_TYPE_CHAR_DEVICE
+	case m&os.ModeDevice != 0:
+		return ssh_FILEXFER_TYPE_BLOCK_DEVICE
+	case m&os.ModeNamedPipe != 0:
+		return ssh_FILEXFER_TYPE_FIFO
+	}
+	return ssh_FILEXFER_TYPE_SPECIAL
+}
+
+func typeToFileMode(typ byte) os.FileMode {
+	switch typ {
+	case ssh_FILEXFER_TYPE_DIRECTORY:
+		return os.ModeDir
+	case ssh_FILEXFER_TYPE_SYMLINK:
+		return os.ModeSymlink
+	case ssh_FILEXFER_TYPE_SOCKET:
+		return os.ModeSocket
+	case ssh_FILEXFER_TYPE_CHAR_DEVICE:
+		return os.ModeDevice | os.ModeCharDevice
+	case ssh_FILEXFER_TYPE_SPECIAL, ssh_FILEXFER_TYPE_BLOCK_DEVICE:
+		return os.ModeDevice
+	case ssh_FILEXFER_TYPE_FIFO:
+		return os.ModeNamedPipe
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/taruti/binp"
+	"github.com/taruti/bytepool"
+)
+
+// The check-file extensions are specified in
+// draft-ietf-secsh-filexfer-extensions-00.
+
+var checkFileHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+var errInvalidBlockSize = errors.New("Invalid check-file block size")
+var errCheckFileTooLarge = errors.New("Too many check-file blocks")
+
+// maxCheckFileReply limits the amount of hash data in a single reply.
+const maxCheckFileReply = 64 * 1024
+
+func checkFileHandle(s *session, payload []byte) ([]byte, error) {
+	var handle, algs string
+	var offset, length uint64
+	var blockSize uint32
+	e := binp.NewParser(payload).B32String(&handle).B32String(&algs).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		return nil, e
+	}
+	f := s.h.getFile(handle)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	return checkFile(f, algs, offset, length, blockSize)
+}
+
+func checkFileName(s *session, payload []byte) ([]byte, error) {
+	var path, algs string
+	var offset, length uint64
+	var blockSize uint32
+	e := binp.NewParser(payload).B32String(&path).B32String(&algs).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		return nil, e
+	}
+	r := OpenRequest{Path: path}
+	r.decodeFlags3(ssh_FXF_READ)
+	f, e := openFile(s.fs, &r)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return checkFile(f, algs, offset, length, blockSize)
+}
+
+func checkFile(f File, algs string, offset, length uint64, blockSize uint32) ([]byte, error) {
+	if blockSize != 0 && blockSize < 256 {
+		return nil, errInvalidBlockSize
+	}
+	var alg string
+	var newHash func() hash.Hash
+	for _, a := range strings.Split(algs, ",") {
+		if newHash = checkFileHashes[a]; newHash != nil {
+			alg = a
+			break
+		}
+	}
+	if newHash == nil {
+		return nil, ErrUnsupported
+	}
+	var sums []byte
+	var e = ErrUnsupported
+	if fh, ok := optional(f).(FileHasher); ok {
+		sums, e = fh.Hash(alg, offset, length, blockSize)
+	}
+	if e == ErrUnsupported {
+		sums, e = hashFile(f, newHash(), offset, length, blockSize)
+	}
+	if e != nil {
+		return nil, e
+	}
+	return append(binp.Out().B32String("check-file").B32String(alg).Out(), sums...), nil
+}
+
+func hashFile(f File, h hash.Hash, offset, length uint64, blockSize uint32) ([]byte, error) {
+	bs := bytepool.Alloc(64 * 1024)
+	defer bytepool.Free(bs)
+	var sums []byte
+	var inBlock uint64
+	end := offset + length
+	for {
+		buf := bs
+		if length != 0 && end-offset < uint64(len(buf)) {
+			buf = buf[:end-offset]
+		}
+		if blockSize != 0 && uint64(blockSize)-inBlock < uint64(len(buf)) {
+			buf = buf[:uint64(blockSize)-inBlock]
+		}
+		if len(buf) == 0 {
+			break
+		}
+		n, e := f.ReadAt(buf, int64(offset))
+		h.Write(buf[:n])
+		offset += uint64(n)
+		inBlock += uint64(n)
+		if blockSize != 0 && inBlock == uint64(blockSize) {
+			sums = h.Sum(sums)
+			h.Reset()
+			inBlock = 0
+			if len(sums) > maxCheckFileReply {
+				return nil, errCheckFileTooLarge
+			}
+		}
+		if e != nil && e != io.EOF {
+			return nil, e
+		}
+		if e == io.EOF || n == 0 {
+			break
+		}
+	}
+	if inBlock > 0 || len(sums) == 0 {
+		sums = h.Sum(sums)
+	}
+	return sums, nil
+}
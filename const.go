@@ -21,6 +21,9 @@ const (
 	ssh_FXP_RENAME         = 18
 	ssh_FXP_READLINK       = 19
 	ssh_FXP_SYMLINK        = 20
+	ssh_FXP_LINK           = 21
+	ssh_FXP_BLOCK          = 22
+	ssh_FXP_UNBLOCK        = 23
 	ssh_FXP_STATUS         = 101
 	ssh_FXP_HANDLE         = 102
 	ssh_FXP_DATA           = 103
@@ -40,6 +43,32 @@ const (
 	ssh_FX_NO_CONNECTION     = 6
 	ssh_FX_CONNECTION_LOST   = 7
 	ssh_FX_OP_UNSUPPORTED    = 8
+	// Protocol version 4 and later.
+	ssh_FX_INVALID_HANDLE      = 9
+	ssh_FX_NO_SUCH_PATH        = 10
+	ssh_FX_FILE_ALREADY_EXISTS = 11
+	ssh_FX_WRITE_PROTECT       = 12
+	ssh_FX_NO_MEDIA            = 13
+	// Protocol version 5 and later.
+	ssh_FX_NO_SPACE_ON_FILESYSTEM = 14
+	ssh_FX_QUOTA_EXCEEDED         = 15
+	ssh_FX_UNKNOWN_PRINCIPAL      = 16
+	ssh_FX_LOCK_CONFLICT          = 17
+	// Protocol version 6.
+	ssh_FX_DIR_NOT_EMPTY               = 18
+	ssh_FX_NOT_A_DIRECTORY             = 19
+	ssh_FX_INVALID_FILENAME            = 20
+	ssh_FX_LINK_LOOP                   = 21
+	ssh_FX_CANNOT_DELETE               = 22
+	ssh_FX_INVALID_PARAMETER           = 23
+	ssh_FX_FILE_IS_A_DIRECTORY         = 24
+	ssh_FX_BYTE_RANGE_LOCK_CONFLICT    = 25
+	ssh_FX_BYTE_RANGE_LOCK_REFUSED     = 26
+	ssh_FX_DELETE_PENDING              = 27
+	ssh_FX_FILE_CORRUPT                = 28
+	ssh_FX_OWNER_INVALID               = 29
+	ssh_FX_GROUP_INVALID               = 30
+	ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK = 31
 )
 
 const (
@@ -50,6 +79,101 @@ const (
 	ssh_FILEXFER_ATTR_EXTENDED    = 0x80000000
 )
 
+// Attribute flags for protocol version 4 and later.
+const (
+	ssh_FILEXFER_ATTR_ACCESSTIME      = 0x00000008
+	ssh_FILEXFER_ATTR_CREATETIME      = 0x00000010
+	ssh_FILEXFER_ATTR_MODIFYTIME      = 0x00000020
+	ssh_FILEXFER_ATTR_ACL             = 0x00000040
+	ssh_FILEXFER_ATTR_OWNERGROUP      = 0x00000080
+	ssh_FILEXFER_ATTR_SUBSECOND_TIMES = 0x00000100
+	// Protocol version 5 and later.
+	ssh_FILEXFER_ATTR_BITS = 0x00000200
+	// Protocol version 6.
+	ssh_FILEXFER_ATTR_ALLOCATION_SIZE   = 0x00000400
+	ssh_FILEXFER_ATTR_TEXT_HINT         = 0x00000800
+	ssh_FILEXFER_ATTR_MIME_TYPE         = 0x00001000
+	ssh_FILEXFER_ATTR_LINK_COUNT        = 0x00002000
+	ssh_FILEXFER_ATTR_UNTRANSLATED_NAME = 0x00004000
+	ssh_FILEXFER_ATTR_CTIME             = 0x00008000
+)
+
+const (
+	ssh_FILEXFER_TYPE_REGULAR   = 1
+	ssh_FILEXFER_TYPE_DIRECTORY = 2
+	ssh_FILEXFER_TYPE_SYMLINK   = 3
+	ssh_FILEXFER_TYPE_SPECIAL   = 4
+	ssh_FILEXFER_TYPE_UNKNOWN   = 5
+	// Protocol version 5 and later.
+	ssh_FILEXFER_TYPE_SOCKET       = 6
+	ssh_FILEXFER_TYPE_CHAR_DEVICE  = 7
+	ssh_FILEXFER_TYPE_BLOCK_DEVICE = 8
+	ssh_FILEXFER_TYPE_FIFO         = 9
+)
+
+const (
+	ssh_FILEXFER_ATTR_FLAGS_READONLY         = 0x00000001
+	ssh_FILEXFER_ATTR_FLAGS_SYSTEM           = 0x00000002
+	ssh_FILEXFER_ATTR_FLAGS_HIDDEN           = 0x00000004
+	ssh_FILEXFER_ATTR_FLAGS_CASE_INSENSITIVE = 0x00000008
+	ssh_FILEXFER_ATTR_FLAGS_ARCHIVE          = 0x00000010
+	ssh_FILEXFER_ATTR_FLAGS_ENCRYPTED        = 0x00000020
+	ssh_FILEXFER_ATTR_FLAGS_COMPRESSED       = 0x00000040
+	ssh_FILEXFER_ATTR_FLAGS_SPARSE           = 0x00000080
+	ssh_FILEXFER_ATTR_FLAGS_APPEND_ONLY      = 0x00000100
+	ssh_FILEXFER_ATTR_FLAGS_IMMUTABLE        = 0x00000200
+	ssh_FILEXFER_ATTR_FLAGS_SYNC             = 0x00000400
+)
+
+const (
+	ssh_FXF_READ   = 0x00000001
+	ssh_FXF_WRITE  = 0x00000002
+	ssh_FXF_APPEND = 0x00000004
+	ssh_FXF_CREAT  = 0x00000008
+	ssh_FXF_TRUNC  = 0x00000010
+	ssh_FXF_EXCL   = 0x00000020
+	ssh_FXF_TEXT   = 0x00000040
+)
+
+// Open flags for protocol version 5 and later.
+const (
+	ssh_FXF_ACCESS_DISPOSITION = 0x00000007
+	ssh_FXF_CREATE_NEW         = 0x00000000
+	ssh_FXF_CREATE_TRUNCATE    = 0x00000001
+	ssh_FXF_OPEN_EXISTING      = 0x00000002
+	ssh_FXF_OPEN_OR_CREATE     = 0x00000003
+	ssh_FXF_TRUNCATE_EXISTING  = 0x00000004
+	ssh_FXF_APPEND_DATA        = 0x00000008
+	ssh_FXF_APPEND_DATA_ATOMIC = 0x00000010
+	ssh_FXF_TEXT_MODE          = 0x00000020
+	ssh_FXF_BLOCK_READ         = 0x00000040
+	ssh_FXF_BLOCK_WRITE        = 0x00000080
+	ssh_FXF_BLOCK_DELETE       = 0x00000100
+	ssh_FXF_BLOCK_ADVISORY     = 0x00000200
+	ssh_FXF_NOFOLLOW           = 0x00000400
+	ssh_FXF_DELETE_ON_CLOSE    = 0x00000800
+)
+
+const (
+	ace4_READ_DATA        = 0x00000001
+	ace4_WRITE_DATA       = 0x00000002
+	ace4_APPEND_DATA      = 0x00000004
+	ace4_READ_ATTRIBUTES  = 0x00000080
+	ace4_WRITE_ATTRIBUTES = 0x00000100
+)
+
+const (
+	ssh_FXP_REALPATH_NO_CHECK    = 0x00000001
+	ssh_FXP_REALPATH_STAT_IF     = 0x00000002
+	ssh_FXP_REALPATH_STAT_ALWAYS = 0x00000003
+)
+
+const (
+	ssh_FXF_RENAME_OVERWRITE = 0x00000001
+	ssh_FXF_RENAME_ATOMIC    = 0x00000002
+	ssh_FXF_RENAME_NATIVE    = 0x00000004
+)
+
 // These are used to get more pretty debugging output.
 type ssh_fxp byte
 type ssh_fx byte
@@ -0,0 +1,264 @@
+package sftpd
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ContextFileSystem is the variant of FileSystem receiving the context
+// of the session in every call. The context carries the ssh.ConnMetadata
+// and ssh.Permissions of the connection if known and is cancelled when
+// the channel is closed.
+//
+// Optional interfaces like StatVFSer or Syncer are detected on
+// ContextFileSystem, ContextFile and ContextDir values too, with their
+// usual methods which do not receive the context. Opener and DataCopier
+// have the variants ContextOpener and ContextDataCopier instead, which
+// receive the context and ContextFiles.
+type ContextFileSystem interface {
+	OpenFile(ctx context.Context, name string, flags uint32, attr *Attr) (ContextFile, error)
+	OpenDir(ctx context.Context, name string) (ContextDir, error)
+	Remove(ctx context.Context, name string) error
+	Rename(ctx context.Context, old string, new string, flags uint32) error
+	Mkdir(ctx context.Context, name string, attr *Attr) error
+	Rmdir(ctx context.Context, name string) error
+	Stat(ctx context.Context, name string, islstat bool) (*Attr, error)
+	SetStat(ctx context.Context, name string, attr *Attr) error
+	ReadLink(ctx context.Context, path string) (string, error)
+	CreateLink(ctx context.Context, path string, target string, flags uint32) error
+	RealPath(ctx context.Context, path string) (string, error)
+}
+
+// ContextFile is the variant of File used by ContextFileSystem.
+type ContextFile interface {
+	io.Closer
+	ReadAt(ctx context.Context, bs []byte, offset int64) (int, error)
+	WriteAt(ctx context.Context, bs []byte, offset int64) (int, error)
+	FStat(ctx context.Context) (*Attr, error)
+	FSetStat(ctx context.Context, attr *Attr) error
+}
+
+// ContextOpener is the variant of Opener for a ContextFileSystem.
+type ContextOpener interface {
+	Open(ctx context.Context, r *OpenRequest) (ContextFile, error)
+}
+
+// ContextDataCopier is the variant of DataCopier for a ContextFile.
+// The destination is a ContextFile of the same ContextFileSystem.
+type ContextDataCopier interface {
+	CopyData(ctx context.Context, offset, length uint64, dst ContextFile, dstOffset uint64) error
+}
+
+// ContextDir is the variant of Dir used by ContextFileSystem.
+type ContextDir interface {
+	io.Closer
+	Readdir(ctx context.Context, count int) ([]NamedAttr, error)
+}
+
+type contextKey int
+
+const (
+	connMetadataKey contextKey = iota
+	permissionsKey
+	activityKey
+)
+
+// NewConnContext returns a context carrying the metadata and permissions
+// of a connection. Config servers pass such contexts to ContextFileSystems.
+func NewConnContext(ctx context.Context, conn ssh.ConnMetadata, perms *ssh.Permissions) context.Context {
+	ctx = context.WithValue(ctx, connMetadataKey, conn)
+	return context.WithValue(ctx, permissionsKey, perms)
+}
+
+// ConnMetadataFromContext returns the metadata of the connection
+// of a session, e.g. the name of the user.
+func ConnMetadataFromContext(ctx context.Context) (ssh.ConnMetadata, bool) {
+	conn, ok := ctx.Value(connMetadataKey).(ssh.ConnMetadata)
+	return conn, ok
+}
+
+// PermissionsFromContext returns the permissions set by the
+// authentication callbacks for the connection of a session.
+func PermissionsFromContext(ctx context.Context) (*ssh.Permissions, bool) {
+	perms, ok := ctx.Value(permissionsKey).(*ssh.Permissions)
+	return perms, ok && perms != nil
+}
+
+// ContextAdapter makes a FileSystem usable as a ContextFileSystem.
+// The context is ignored.
+func ContextAdapter(fs FileSystem) ContextFileSystem {
+	return contextAdapter{fs}
+}
+
+type contextAdapter struct{ fs FileSystem }
+
+func (a contextAdapter) OpenFile(_ context.Context, name string, flags uint32, attr *Attr) (ContextFile, error) {
+	f, e := a.fs.OpenFile(name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	return fileAdapter{f}, nil
+}
+func (a contextAdapter) OpenDir(_ context.Context, name string) (ContextDir, error) {
+	d, e := a.fs.OpenDir(name)
+	if e != nil {
+		return nil, e
+	}
+	return dirAdapter{d}, nil
+}
+func (a contextAdapter) Remove(_ context.Context, name string) error { return a.fs.Remove(name) }
+func (a contextAdapter) Rename(_ context.Context, old, new string, flags uint32) error {
+	return a.fs.Rename(old, new, flags)
+}
+func (a contextAdapter) Mkdir(_ context.Context, name string, attr *Attr) error {
+	return a.fs.Mkdir(name, attr)
+}
+func (a contextAdapter) Rmdir(_ context.Context, name string) error { return a.fs.Rmdir(name) }
+func (a contextAdapter) Stat(_ context.Context, name string, islstat bool) (*Attr, error) {
+	return a.fs.Stat(name, islstat)
+}
+func (a contextAdapter) SetStat(_ context.Context, name string, attr *Attr) error {
+	return a.fs.SetStat(name, attr)
+}
+func (a contextAdapter) ReadLink(_ context.Context, path string) (string, error) {
+	return a.fs.ReadLink(path)
+}
+func (a contextAdapter) CreateLink(_ context.Context, path, target string, flags uint32) error {
+	return a.fs.CreateLink(path, target, flags)
+}
+func (a contextAdapter) RealPath(_ context.Context, path string) (string, error) {
+	return a.fs.RealPath(path)
+}
+
+type fileAdapter struct{ f File }
+
+func (a fileAdapter) Close() error { return a.f.Close() }
+func (a fileAdapter) ReadAt(_ context.Context, bs []byte, offset int64) (int, error) {
+	return a.f.ReadAt(bs, offset)
+}
+func (a fileAdapter) WriteAt(_ context.Context, bs []byte, offset int64) (int, error) {
+	return a.f.WriteAt(bs, offset)
+}
+func (a fileAdapter) FStat(context.Context) (*Attr, error)         { return a.f.FStat() }
+func (a fileAdapter) FSetStat(_ context.Context, attr *Attr) error { return a.f.FSetStat(attr) }
+
+type dirAdapter struct{ d Dir }
+
+func (a dirAdapter) Close() error { return a.d.Close() }
+func (a dirAdapter) Readdir(_ context.Context, count int) ([]NamedAttr, error) {
+	return a.d.Readdir(count)
+}
+
+// bindContext returns a FileSystem serving fs with the context of
+// a session. FileSystems wrapped by ContextAdapter are unwrapped.
+func bindContext(ctx context.Context, fs ContextFileSystem) FileSystem {
+	if a, ok := fs.(contextAdapter); ok {
+		return a.fs
+	}
+	return &boundFS{ctx: ctx, fs: fs}
+}
+
+type boundFS struct {
+	ctx context.Context
+	fs  ContextFileSystem
+}
+
+func (b *boundFS) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	f, e := b.fs.OpenFile(b.ctx, name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	return &boundFile{ctx: b.ctx, f: f}, nil
+}
+func (b *boundFS) OpenDir(name string) (Dir, error) {
+	d, e := b.fs.OpenDir(b.ctx, name)
+	if e != nil {
+		return nil, e
+	}
+	return &boundDir{ctx: b.ctx, d: d}, nil
+}
+func (b *boundFS) Remove(name string) error { return b.fs.Remove(b.ctx, name) }
+func (b *boundFS) Rename(old, new string, flags uint32) error {
+	return b.fs.Rename(b.ctx, old, new, flags)
+}
+func (b *boundFS) Mkdir(name string, attr *Attr) error { return b.fs.Mkdir(b.ctx, name, attr) }
+func (b *boundFS) Rmdir(name string) error             { return b.fs.Rmdir(b.ctx, name) }
+func (b *boundFS) Stat(name string, islstat bool) (*Attr, error) {
+	return b.fs.Stat(b.ctx, name, islstat)
+}
+func (b *boundFS) SetStat(name string, attr *Attr) error { return b.fs.SetStat(b.ctx, name, attr) }
+func (b *boundFS) ReadLink(path string) (string, error)  { return b.fs.ReadLink(b.ctx, path) }
+func (b *boundFS) CreateLink(path, target string, flags uint32) error {
+	return b.fs.CreateLink(b.ctx, path, target, flags)
+}
+func (b *boundFS) RealPath(path string) (string, error) { return b.fs.RealPath(b.ctx, path) }
+
+type boundFile struct {
+	ctx context.Context
+	f   ContextFile
+}
+
+func (b *boundFile) Close() error { return b.f.Close() }
+func (b *boundFile) ReadAt(bs []byte, offset int64) (int, error) {
+	return b.f.ReadAt(b.ctx, bs, offset)
+}
+func (b *boundFile) WriteAt(bs []byte, offset int64) (int, error) {
+	return b.f.WriteAt(b.ctx, bs, offset)
+}
+func (b *boundFile) FStat() (*Attr, error)     { return b.f.FStat(b.ctx) }
+func (b *boundFile) FSetStat(attr *Attr) error { return b.f.FSetStat(b.ctx, attr) }
+
+type boundDir struct {
+	ctx context.Context
+	d   ContextDir
+}
+
+func (b *boundDir) Close() error { return b.d.Close() }
+func (b *boundDir) Readdir(count int) ([]NamedAttr, error) {
+	return b.d.Readdir(b.ctx, count)
+}
+
+// unbindFS returns the context and ContextFileSystem of a session's
+// FileSystem, which is adapted if it is not bound to a context.
+func unbindFS(fs FileSystem) (context.Context, ContextFileSystem) {
+	if b, ok := fs.(*boundFS); ok {
+		return b.ctx, b.fs
+	}
+	return context.Background(), contextAdapter{fs}
+}
+
+// unbindFile returns the ContextFile of a File served by a session.
+func unbindFile(f File) ContextFile {
+	switch b := f.(type) {
+	case nil:
+		return nil
+	case *boundFile:
+		return b.f
+	}
+	return fileAdapter{f}
+}
+
+// unbindDir returns the ContextDir of a Dir served by a session.
+func unbindDir(d Dir) ContextDir {
+	switch b := d.(type) {
+	case nil:
+		return nil
+	case *boundDir:
+		return b.d
+	}
+	return dirAdapter{d}
+}
+
+// optional returns the value to check for optional interfaces,
+// which is the wrapped value for ones bound to a context.
+func optional(v interface{}) interface{} {
+	switch b := v.(type) {
+	case *boundFS:
+		return b.fs
+	case *boundFile:
+		return b.f
+	}
+	return v
+}
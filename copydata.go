@@ -0,0 +1,75 @@
+package sftpd
+
+import (
+	"io"
+
+	"github.com/taruti/binp"
+	"github.com/taruti/bytepool"
+)
+
+// copyData implements the copy-data extension from
+// draft-ietf-secsh-filexfer-extensions-00.
+func copyData(s *session, payload []byte) ([]byte, error) {
+	var rhandle, whandle string
+	var roffset, length, woffset uint64
+	e := binp.NewParser(payload).B32String(&rhandle).B64(&roffset).B64(&length).B32String(&whandle).B64(&woffset).End()
+	if e != nil {
+		return nil, e
+	}
+	src, dst := s.h.getFile(rhandle), s.h.getFile(whandle)
+	if src == nil || dst == nil {
+		return nil, errInvalidHandle
+	}
+	if rhandle == whandle && copyOverlaps(roffset, length, woffset) {
+		return nil, errCopyOverlap
+	}
+	if b, ok := src.(*boundFile); ok {
+		if dc, ok := b.f.(ContextDataCopier); ok {
+			e = dc.CopyData(b.ctx, roffset, length, unbindFile(dst), woffset)
+			if e != ErrUnsupported {
+				return nil, e
+			}
+		}
+	} else if dc, ok := src.(DataCopier); ok {
+		e = dc.CopyData(roffset, length, dst, woffset)
+		if e != ErrUnsupported {
+			return nil, e
+		}
+	}
+	return nil, copyDataLoop(src, roffset, length, dst, woffset)
+}
+
+func copyOverlaps(roffset, length, woffset uint64) bool {
+	if length == 0 {
+		return woffset >= roffset
+	}
+	return roffset < woffset+length && woffset < roffset+length
+}
+
+func copyDataLoop(src File, roffset, length uint64, dst File, woffset uint64) error {
+	bs := bytepool.Alloc(64 * 1024)
+	defer bytepool.Free(bs)
+	for remaining := length; length == 0 || remaining > 0; {
+		buf := bs
+		if length != 0 && remaining < uint64(len(buf)) {
+			buf = buf[:remaining]
+		}
+		n, e := src.ReadAt(buf, int64(roffset))
+		if n > 0 {
+			_, we := dst.WriteAt(buf[:n], int64(woffset))
+			if we != nil {
+				return we
+			}
+			roffset += uint64(n)
+			woffset += uint64(n)
+			remaining -= uint64(n)
+		}
+		if e != nil && e != io.EOF {
+			return e
+		}
+		if e == io.EOF || n == 0 {
+			return nil
+		}
+	}
+	return nil
+}
@@ -39,6 +39,9 @@ var ssh_fxp_map = map[ssh_fxp]string{
 	ssh_FXP_RENAME:         `ssh_FXP_RENAME`,
 	ssh_FXP_READLINK:       `ssh_FXP_READLINK`,
 	ssh_FXP_SYMLINK:        `ssh_FXP_SYMLINK`,
+	ssh_FXP_LINK:           `ssh_FXP_LINK`,
+	ssh_FXP_BLOCK:          `ssh_FXP_BLOCK`,
+	ssh_FXP_UNBLOCK:        `ssh_FXP_UNBLOCK`,
 	ssh_FXP_STATUS:         `ssh_FXP_STATUS`,
 	ssh_FXP_HANDLE:         `ssh_FXP_HANDLE`,
 	ssh_FXP_DATA:           `ssh_FXP_DATA`,
@@ -66,4 +69,28 @@ var ssh_fx_map = map[ssh_fx]string{
 	ssh_FX_NO_CONNECTION:     `ssh_FX_NO_CONNECTION`,
 	ssh_FX_CONNECTION_LOST:   `ssh_FX_CONNECTION_LOST`,
 	ssh_FX_OP_UNSUPPORTED:    `ssh_FX_OP_UNSUPPORTED`,
+
+	ssh_FX_INVALID_HANDLE:              `ssh_FX_INVALID_HANDLE`,
+	ssh_FX_NO_SUCH_PATH:                `ssh_FX_NO_SUCH_PATH`,
+	ssh_FX_FILE_ALREADY_EXISTS:         `ssh_FX_FILE_ALREADY_EXISTS`,
+	ssh_FX_WRITE_PROTECT:               `ssh_FX_WRITE_PROTECT`,
+	ssh_FX_NO_MEDIA:                    `ssh_FX_NO_MEDIA`,
+	ssh_FX_NO_SPACE_ON_FILESYSTEM:      `ssh_FX_NO_SPACE_ON_FILESYSTEM`,
+	ssh_FX_QUOTA_EXCEEDED:              `ssh_FX_QUOTA_EXCEEDED`,
+	ssh_FX_UNKNOWN_PRINCIPAL:           `ssh_FX_UNKNOWN_PRINCIPAL`,
+	ssh_FX_LOCK_CONFLICT:               `ssh_FX_LOCK_CONFLICT`,
+	ssh_FX_DIR_NOT_EMPTY:               `ssh_FX_DIR_NOT_EMPTY`,
+	ssh_FX_NOT_A_DIRECTORY:             `ssh_FX_NOT_A_DIRECTORY`,
+	ssh_FX_INVALID_FILENAME:            `ssh_FX_INVALID_FILENAME`,
+	ssh_FX_LINK_LOOP:                   `ssh_FX_LINK_LOOP`,
+	ssh_FX_CANNOT_DELETE:               `ssh_FX_CANNOT_DELETE`,
+	ssh_FX_INVALID_PARAMETER:           `ssh_FX_INVALID_PARAMETER`,
+	ssh_FX_FILE_IS_A_DIRECTORY:         `ssh_FX_FILE_IS_A_DIRECTORY`,
+	ssh_FX_BYTE_RANGE_LOCK_CONFLICT:    `ssh_FX_BYTE_RANGE_LOCK_CONFLICT`,
+	ssh_FX_BYTE_RANGE_LOCK_REFUSED:     `ssh_FX_BYTE_RANGE_LOCK_REFUSED`,
+	ssh_FX_DELETE_PENDING:              `ssh_FX_DELETE_PENDING`,
+	ssh_FX_FILE_CORRUPT:                `ssh_FX_FILE_CORRUPT`,
+	ssh_FX_OWNER_INVALID:               `ssh_FX_OWNER_INVALID`,
+	ssh_FX_GROUP_INVALID:               `ssh_FX_GROUP_INVALID`,
+	ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK: `ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK`,
 }
@@ -7,6 +7,10 @@ import (
 
 var Failure = errors.New("Failure")
 
+// ErrUnsupported can be returned by FileSystem, File and Dir methods
+// to reply SSH_FX_OP_UNSUPPORTED to the client.
+var ErrUnsupported = errors.New("Operation unsupported")
+
 type EmptyFile struct{}
 
 func (EmptyFile) Close() error                       { return nil }
@@ -17,17 +21,20 @@ func (EmptyFile) FSetStat(*Attr) error               { return Failure }
 
 type EmptyFS struct{}
 
-func (EmptyFS) OpenFile(string, uint32, *Attr) (File, error)  { return nil, Failure }
-func (EmptyFS) OpenDir(string) (Dir, error)                   { return nil, Failure }
-func (EmptyFS) Remove(string) error                           { return Failure }
-func (EmptyFS) Rename(string, string, uint32) error           { return Failure }
-func (EmptyFS) Mkdir(string, *Attr) error                     { return Failure }
-func (EmptyFS) Rmdir(string) error                            { return Failure }
-func (EmptyFS) Stat(string, bool) (*Attr, error)              { return nil, Failure }
-func (EmptyFS) SetStat(string, *Attr) error                   { return Failure }
-func (EmptyFS) ReadLink(p string) (string, error)             { return "", Failure }
-func (EmptyFS) CreateLink(p string, t string, f uint32) error { return Failure }
-func (EmptyFS) RealPath(p string) (string, error)             { return simpleRealPath(p), nil }
+func (EmptyFS) OpenFile(string, uint32, *Attr) (File, error) { return nil, Failure }
+func (EmptyFS) OpenDir(string) (Dir, error)                  { return nil, Failure }
+func (EmptyFS) Remove(string) error                          { return Failure }
+func (EmptyFS) Rename(string, string, uint32) error          { return Failure }
+func (EmptyFS) Mkdir(string, *Attr) error                    { return Failure }
+func (EmptyFS) Rmdir(string) error                           { return Failure }
+func (EmptyFS) Stat(string, bool) (*Attr, error)             { return nil, Failure }
+func (EmptyFS) SetStat(string, *Attr) error                  { return Failure }
+func (EmptyFS) ReadLink(p string) (string, error)            { return "", Failure }
+func (EmptyFS) RealPath(p string) (string, error)            { return simpleRealPath(p), nil }
+
+// CreateLink fails with ErrUnsupported as EmptyFS supports no links
+// of either kind.
+func (EmptyFS) CreateLink(p string, t string, f uint32) error { return ErrUnsupported }
 
 func simpleRealPath(fp string) string {
 	switch fp {
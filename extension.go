@@ -0,0 +1,143 @@
+package sftpd
+
+import (
+	"context"
+	"sort"
+
+	"github.com/taruti/binp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExtensionHandler handles a SSH_FXP_EXTENDED request for a FileSystem.
+// Handles resolves the handles of the channel the request was received
+// on. The payload contains the request specific data following the
+// extension name and is only valid during the call.
+//
+// If err is nil and reply is non-nil the reply is sent to the client as
+// the body of a SSH_FXP_EXTENDED_REPLY packet. Otherwise a SSH_FXP_STATUS
+// packet with a status code derived from err is sent.
+type ExtensionHandler func(fs FileSystem, h Handles, payload []byte) (reply []byte, err error)
+
+// Handles resolves the file and directory handles of a channel.
+type Handles interface {
+	// File returns the file of handle or nil if it is not an open file.
+	File(handle string) File
+	// Dir returns the directory of handle or nil if it is not an open
+	// directory.
+	Dir(handle string) Dir
+}
+
+// ContextExtensionHandler is the variant of ExtensionHandler for a
+// ContextFileSystem. The context is the one passed to fs for the
+// session, FileSystems served without one are adapted with
+// ContextAdapter and context.Background.
+type ContextExtensionHandler func(ctx context.Context, fs ContextFileSystem, h ContextHandles, payload []byte) (reply []byte, err error)
+
+// ContextHandles is the variant of Handles for a ContextFileSystem.
+type ContextHandles interface {
+	File(handle string) ContextFile
+	Dir(handle string) ContextDir
+}
+
+type contextHandles struct{ h *handles }
+
+func (c contextHandles) File(n string) ContextFile { return unbindFile(c.h.getFile(n)) }
+func (c contextHandles) Dir(n string) ContextDir   { return unbindDir(c.h.getDir(n)) }
+
+// Extension describes a SSH_FXP_EXTENDED request type.
+type Extension struct {
+	// Name is the extension-name, e.g. "foo@example.com".
+	Name string
+	// Data is advertised to clients in the SSH_FXP_VERSION reply,
+	// typically a version number such as "1".
+	Data string
+	// Handler is called for each request with the extension name.
+	Handler ExtensionHandler
+	// ContextHandler is used instead of Handler if set.
+	ContextHandler ContextExtensionHandler
+}
+
+// builtinExtension is an extension implemented by this package.
+type builtinExtension struct {
+	data string
+	// supported reports whether a FileSystem can serve the extension,
+	// nil means that all of them can.
+	supported func(fs FileSystem) bool
+	handler   func(s *session, payload []byte) ([]byte, error)
+	// replyType is the packet type of replies, SSH_FXP_EXTENDED_REPLY
+	// if zero.
+	replyType byte
+}
+
+var builtinExtensions = map[string]builtinExtension{
+	"posix-rename@openssh.com":       {data: "1", handler: posixRename},
+	"hardlink@openssh.com":           {data: "1", handler: hardlink},
+	"fsync@openssh.com":              {data: "1", handler: fsync},
+	"copy-data":                      {data: "1", handler: copyData},
+	"check-file-handle":              {data: "1", handler: checkFileHandle},
+	"check-file-name":                {data: "1", handler: checkFileName},
+	"limits@openssh.com":             {data: "1", handler: limits},
+	"statvfs@openssh.com":            {data: "2", supported: supportsStatVFS, handler: statVFS},
+	"fstatvfs@openssh.com":           {data: "2", supported: supportsStatVFS, handler: fstatVFS},
+	"users-groups-by-id@openssh.com": {data: "1", handler: usersGroupsByID},
+	"lsetstat@openssh.com":           {data: "1", supported: supportsLSetStat, handler: lsetstat},
+	"expand-path@openssh.com":        {data: "1", supported: supportsHomeDir, handler: expandPath, replyType: ssh_FXP_NAME},
+	"home-directory":                 {data: "1", supported: supportsHomeDir, handler: homeDirectory, replyType: ssh_FXP_NAME},
+}
+
+// callExtension runs the named extension. Extensions of the server
+// options take precedence over builtin ones.
+// The reply type is returned with the reply.
+func callExtension(s *session, name string, payload []byte) (byte, []byte, error) {
+	exts := s.opts.Extensions
+	for i := len(exts) - 1; i >= 0; i-- {
+		if exts[i].Name != name {
+			continue
+		}
+		if exts[i].ContextHandler != nil {
+			ctx, fs := unbindFS(s.fs)
+			reply, e := exts[i].ContextHandler(ctx, fs, contextHandles{s.h}, payload)
+			return ssh_FXP_EXTENDED_REPLY, reply, e
+		}
+		reply, e := exts[i].Handler(s.fs, s.h, payload)
+		return ssh_FXP_EXTENDED_REPLY, reply, e
+	}
+	bext, ok := builtinExtensions[name]
+	if ok && (bext.supported == nil || bext.supported(s.fs)) {
+		reply, e := bext.handler(s, payload)
+		if bext.replyType != 0 {
+			return bext.replyType, reply, e
+		}
+		return ssh_FXP_EXTENDED_REPLY, reply, e
+	}
+	return 0, nil, ErrUnsupported
+}
+
+func writeVersion(c ssh.Channel, s *session) error {
+	data := map[string]string{}
+	for name, bext := range builtinExtensions {
+		if bext.supported == nil || bext.supported(s.fs) {
+			data[name] = bext.data
+		}
+	}
+	for _, ext := range s.opts.Extensions {
+		data[ext.Name] = ext.Data
+	}
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_VERSION).B32(s.version)
+	for _, name := range names {
+		o.B32String(name).B32String(data[name])
+	}
+	o.LenDone(&l)
+	return wrc(c, o.Out())
+}
+
+func writeReply(c ssh.Channel, typ byte, id uint32, bs []byte) error {
+	o := binp.OutCap(4 + 5 + len(bs)).B32(uint32(5 + len(bs))).Byte(typ).B32(id)
+	return wrc(c, append(o.Out(), bs...))
+}
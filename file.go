@@ -13,7 +13,12 @@ type Attr struct {
 	User, Group  string
 	Mode         os.FileMode
 	ATime, MTime time.Time
-	Extended     []string
+	CreateTime   time.Time
+	// AttribBits contains ATTRIB_* values, only the ones in
+	// AttribBitsValid are meaningful.
+	AttribBits      uint32
+	AttribBitsValid uint32
+	Extended        []string
 }
 
 type NamedAttr struct {
@@ -22,14 +27,62 @@ type NamedAttr struct {
 }
 
 const (
-	ATTR_SIZE    = ssh_FILEXFER_ATTR_SIZE
-	ATTR_UIDGID  = ssh_FILEXFER_ATTR_UIDGID
-	ATTR_MODE    = ssh_FILEXFER_ATTR_PERMISSIONS
-	ATTR_TIME    = ssh_FILEXFER_ATTR_ACMODTIME
+	ATTR_SIZE   = ssh_FILEXFER_ATTR_SIZE
+	ATTR_UIDGID = ssh_FILEXFER_ATTR_UIDGID
+	ATTR_MODE   = ssh_FILEXFER_ATTR_PERMISSIONS
+	// ATTR_TIME marks ATime and MTime as valid. Clients using protocol
+	// version 4 or later may set only one of them, the other one is
+	// the zero time.Time then.
+	ATTR_TIME = ssh_FILEXFER_ATTR_ACMODTIME
+	// ATTR_CREATETIME and ATTR_OWNERGROUP (User and Group) are only
+	// used with protocol version 4 and later.
+	ATTR_CREATETIME = ssh_FILEXFER_ATTR_CREATETIME
+	ATTR_OWNERGROUP = ssh_FILEXFER_ATTR_OWNERGROUP
+	// ATTR_BITS (AttribBits) is only used with protocol version 5 and later.
+	ATTR_BITS    = ssh_FILEXFER_ATTR_BITS
 	MODE_REGULAR = os.FileMode(0)
 	MODE_DIR     = os.ModeDir
 )
 
+// Values for Attr.AttribBits.
+const (
+	ATTRIB_READONLY         = ssh_FILEXFER_ATTR_FLAGS_READONLY
+	ATTRIB_SYSTEM           = ssh_FILEXFER_ATTR_FLAGS_SYSTEM
+	ATTRIB_HIDDEN           = ssh_FILEXFER_ATTR_FLAGS_HIDDEN
+	ATTRIB_CASE_INSENSITIVE = ssh_FILEXFER_ATTR_FLAGS_CASE_INSENSITIVE
+	ATTRIB_ARCHIVE          = ssh_FILEXFER_ATTR_FLAGS_ARCHIVE
+	ATTRIB_ENCRYPTED        = ssh_FILEXFER_ATTR_FLAGS_ENCRYPTED
+	ATTRIB_COMPRESSED       = ssh_FILEXFER_ATTR_FLAGS_COMPRESSED
+	ATTRIB_SPARSE           = ssh_FILEXFER_ATTR_FLAGS_SPARSE
+	ATTRIB_APPEND_ONLY      = ssh_FILEXFER_ATTR_FLAGS_APPEND_ONLY
+	ATTRIB_IMMUTABLE        = ssh_FILEXFER_ATTR_FLAGS_IMMUTABLE
+	ATTRIB_SYNC             = ssh_FILEXFER_ATTR_FLAGS_SYNC
+)
+
+// Flags passed to FileSystem.OpenFile.
+const (
+	OPEN_READ   = ssh_FXF_READ
+	OPEN_WRITE  = ssh_FXF_WRITE
+	OPEN_APPEND = ssh_FXF_APPEND
+	OPEN_CREAT  = ssh_FXF_CREAT
+	OPEN_TRUNC  = ssh_FXF_TRUNC
+	OPEN_EXCL   = ssh_FXF_EXCL
+	// OPEN_TEXT is used by protocol version 4 clients to request
+	// text mode, the File should convert newlines to "\r\n".
+	OPEN_TEXT = ssh_FXF_TEXT
+)
+
+// Flags passed to FileSystem.Rename. Plain SSH_FXP_RENAME requests use
+// no flags and should fail if the new path exists.
+const (
+	RENAME_OVERWRITE = ssh_FXF_RENAME_OVERWRITE
+	RENAME_ATOMIC    = ssh_FXF_RENAME_ATOMIC
+	RENAME_NATIVE    = ssh_FXF_RENAME_NATIVE
+	// RENAME_POSIX is used for posix-rename@openssh.com requests which
+	// atomically replace an existing file like rename(2).
+	RENAME_POSIX = RENAME_OVERWRITE | RENAME_ATOMIC
+)
+
 type Dir interface {
 	io.Closer
 	Readdir(count int) ([]NamedAttr, error)
@@ -47,16 +100,159 @@ type FileSystem interface {
 	OpenFile(name string, flags uint32, attr *Attr) (File, error)
 	OpenDir(name string) (Dir, error)
 	Remove(name string) error
+	// Rename renames old to new, flags is a combination of RENAME_* values.
 	Rename(old string, new string, flags uint32) error
 	Mkdir(name string, attr *Attr) error
 	Rmdir(name string) error
 	Stat(name string, islstat bool) (*Attr, error)
 	SetStat(name string, attr *Attr) error
 	ReadLink(path string) (string, error)
+	// CreateLink creates path as a link to target, flags is
+	// LINK_SYMBOLIC or LINK_HARD.
 	CreateLink(path string, target string, flags uint32) error
 	RealPath(path string) (string, error)
 }
 
+// Values for OpenRequest.Disposition.
+const (
+	DISPOSITION_CREATE_NEW        = ssh_FXF_CREATE_NEW
+	DISPOSITION_CREATE_TRUNCATE   = ssh_FXF_CREATE_TRUNCATE
+	DISPOSITION_OPEN_EXISTING     = ssh_FXF_OPEN_EXISTING
+	DISPOSITION_OPEN_OR_CREATE    = ssh_FXF_OPEN_OR_CREATE
+	DISPOSITION_TRUNCATE_EXISTING = ssh_FXF_TRUNCATE_EXISTING
+)
+
+// OpenRequest is a decoded SSH_FXP_OPEN request. Requests of all
+// protocol versions are converted to this form.
+type OpenRequest struct {
+	Path string
+	// Read and Write tell whether reading and writing data is requested.
+	Read, Write bool
+	// Append requests that all writes append to the end of the file.
+	Append bool
+	// Disposition is one of the DISPOSITION_* values.
+	Disposition uint32
+	// Text requests text mode, see OPEN_TEXT.
+	Text bool
+	// NoFollow requests failing if Path is a symbolic link.
+	NoFollow bool
+	// DeleteOnClose requests deleting the file when the handle is closed.
+	DeleteOnClose bool
+	// Access and Flags contain the desired-access (ACE4_*) and flags
+	// fields of protocol version 5 and later, for older versions they
+	// are derived from the other fields.
+	Access, Flags uint32
+	Attr          Attr
+
+	pflags uint32
+}
+
+// Opener is an optional interface for a FileSystem receiving decoded
+// open requests. Open is used instead of OpenFile if implemented.
+// Otherwise OpenFile is called with the equivalent OPEN_* flags, and
+// requests using options without an equivalent such as NoFollow fail
+// with ErrUnsupported.
+type Opener interface {
+	Open(r *OpenRequest) (File, error)
+}
+
+// Blocker is an optional interface for a File supporting byte range
+// locks with SSH_FXP_BLOCK and SSH_FXP_UNBLOCK in protocol version 6.
+// A length of zero means until the end of the file.
+type Blocker interface {
+	Block(offset, length uint64, mask uint32) error
+	Unblock(offset, length uint64) error
+}
+
+// Values for the mask passed to Blocker.Block.
+const (
+	BLOCK_READ     = ssh_FXF_BLOCK_READ
+	BLOCK_WRITE    = ssh_FXF_BLOCK_WRITE
+	BLOCK_DELETE   = ssh_FXF_BLOCK_DELETE
+	BLOCK_ADVISORY = ssh_FXF_BLOCK_ADVISORY
+)
+
+// Flags passed to FileSystem.CreateLink.
+const (
+	LINK_SYMBOLIC = 0x0
+	LINK_HARD     = 0x1
+)
+
+// StatVFS contains file system statistics like statvfs(3).
+type StatVFS struct {
+	BlockSize     uint64 // f_bsize
+	FragmentSize  uint64 // f_frsize
+	Blocks        uint64 // f_blocks in units of FragmentSize
+	BlocksFree    uint64 // f_bfree
+	BlocksAvail   uint64 // f_bavail for unprivileged users
+	Files         uint64 // f_files
+	FilesFree     uint64 // f_ffree
+	FilesAvail    uint64 // f_favail for unprivileged users
+	FilesystemID  uint64 // f_fsid
+	Flags         uint64 // f_flag, a combination of STATVFS_* values
+	MaxNameLength uint64 // f_namemax
+}
+
+const (
+	STATVFS_RDONLY = 0x1
+	STATVFS_NOSUID = 0x2
+)
+
+// StatVFSer is an optional interface for a FileSystem supporting
+// the statvfs@openssh.com and fstatvfs@openssh.com extensions.
+// Files returned by such a FileSystem should implement FStatVFSer.
+type StatVFSer interface {
+	StatVFS(path string) (*StatVFS, error)
+}
+
+// FStatVFSer is an optional interface for a File supporting
+// the fstatvfs@openssh.com extension.
+type FStatVFSer interface {
+	FStatVFS() (*StatVFS, error)
+}
+
+// Syncer is an optional interface for a File supporting
+// the fsync@openssh.com extension.
+type Syncer interface {
+	Sync() error
+}
+
+// DataCopier is an optional interface for a File supporting server
+// side copies to another File of the same FileSystem, like
+// copy_file_range(2). It is used for the copy-data extension.
+// A length of zero copies until the end of the File. Returning
+// ErrUnsupported makes the server fall back to ReadAt and WriteAt.
+type DataCopier interface {
+	CopyData(offset, length uint64, dst File, dstOffset uint64) error
+}
+
+// FileHasher is an optional interface for a File supplying precomputed
+// hashes for the check-file-handle and check-file-name extensions.
+// The algorithm is one of "md5", "sha1", "sha256" or "sha512". The result
+// is the concatenation of the hashes of each blockSize sized block in the
+// range, or a single hash if blockSize is zero. A length of zero means
+// until the end of the File. Returning ErrUnsupported makes the server
+// compute the hashes using ReadAt.
+type FileHasher interface {
+	Hash(algorithm string, offset, length uint64, blockSize uint32) ([]byte, error)
+}
+
+// HomeDirer is an optional interface for a FileSystem supporting
+// the home-directory and expand-path@openssh.com extensions, which
+// clients use for paths starting with "~".
+type HomeDirer interface {
+	// HomeDir returns the home directory of the named user,
+	// or of the user of the session if user is empty.
+	HomeDir(user string) (string, error)
+}
+
+// LSetStater is an optional interface for a FileSystem supporting
+// the lsetstat@openssh.com extension. LSetStat is like SetStat but
+// does not follow symbolic links, analogous to islstat for Stat.
+type LSetStater interface {
+	LSetStat(name string, attr *Attr) error
+}
+
 // FillFrom fills an Attr from a os.FileInfo
 func (a *Attr) FillFrom(fi os.FileInfo) {
 	*a = Attr{}
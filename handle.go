@@ -1,8 +1,15 @@
 package sftpd
 
-import "strconv"
+import (
+	"io"
+	"strconv"
+	"sync"
+)
 
+// handles contains the open handles of a session. It is safe for
+// concurrent use by workers.
 type handles struct {
+	sync.Mutex
 	f map[string]File
 	d map[string]Dir
 	c int64
@@ -13,11 +20,17 @@ func (h *handles) init() {
 	h.d = map[string]Dir{}
 }
 
+// closeAll closes the open handles and removes them. The handles
+// are closed without holding the lock as closing may be slow.
 func (h *handles) closeAll() {
-	for _, x := range h.f {
+	h.Lock()
+	fs, ds := h.f, h.d
+	h.init()
+	h.Unlock()
+	for _, x := range fs {
 		x.Close()
 	}
-	for _, x := range h.d {
+	for _, x := range ds {
 		x.Close()
 	}
 }
@@ -25,38 +38,55 @@ func (h *handles) closeHandle(k string) {
 	if k == "" {
 		return
 	}
+	var x io.Closer
+	h.Lock()
 	if k[0] == 'f' {
-		x, ok := h.f[k]
-		if ok {
-			x.Close()
+		if f, ok := h.f[k]; ok {
+			x = f
 		}
 		delete(h.f, k)
 	} else if k[0] == 'd' {
-		x, ok := h.d[k]
-		if ok {
-			x.Close()
+		if d, ok := h.d[k]; ok {
+			x = d
 		}
 		delete(h.d, k)
 	}
+	h.Unlock()
+	if x != nil {
+		x.Close()
+	}
+}
+func (h *handles) count() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.f) + len(h.d)
 }
-func (h *handles) nfiles() int { return len(h.f) }
-func (h *handles) ndir() int   { return len(h.d) }
 
 func (h *handles) newFile(f File) string {
+	h.Lock()
+	defer h.Unlock()
 	h.c++
 	k := "f" + strconv.FormatInt(h.c, 16)
 	h.f[k] = f
 	return k
 }
 func (h *handles) newDir(f Dir) string {
+	h.Lock()
+	defer h.Unlock()
 	h.c++
 	k := "d" + strconv.FormatInt(h.c, 16)
 	h.d[k] = f
 	return k
 }
 func (h *handles) getFile(n string) File {
+	h.Lock()
+	defer h.Unlock()
 	return h.f[n]
 }
 func (h *handles) getDir(n string) Dir {
+	h.Lock()
+	defer h.Unlock()
 	return h.d[n]
 }
+func (h *handles) File(n string) File { return h.getFile(n) }
+func (h *handles) Dir(n string) Dir   { return h.getDir(n) }
@@ -1,7 +1,12 @@
 package sftpd
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -19,62 +24,184 @@ type Config struct {
 	LogFunc func(v ...interface{})
 	// FileSystem contains the FileSystem used for this server.
 	FileSystem FileSystem
+	// ContextFileSystem is used instead of FileSystem if set. The
+	// contexts passed to it carry the ssh.ConnMetadata and
+	// ssh.Permissions of the connection.
+	ContextFileSystem ContextFileSystem
+	// FileSystemFunc is called after authentication of each connection
+	// to return the FileSystem used for it, e.g. with a root depending
+	// on the user. It is used instead of FileSystem and ContextFileSystem
+	// if set. Returning an error closes the connection.
+	FileSystemFunc func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error)
+	// ReleaseFileSystem is called with the FileSystem returned by
+	// FileSystemFunc when the connection has ended and all its channels
+	// have been served.
+	ReleaseFileSystem func(conn ssh.ConnMetadata, fs FileSystem)
+	// ContextFileSystemFunc and ReleaseContextFileSystem are the
+	// equivalents of FileSystemFunc and ReleaseFileSystem for a
+	// ContextFileSystem. ContextFileSystemFunc is used instead of
+	// FileSystemFunc if set.
+	ContextFileSystemFunc    func(conn ssh.ConnMetadata, perms *ssh.Permissions) (ContextFileSystem, error)
+	ReleaseContextFileSystem func(conn ssh.ConnMetadata, fs ContextFileSystem)
+	// Options contains the settings used for serving sftp channels.
+	Options ServerOptions
+	// MaxConnections limits the number of concurrent connections,
+	// MaxConnectionsPerIP the number of them from a single address and
+	// MaxChannelsPerConnection the number of sftp channels served
+	// concurrently for a connection. Rejected connections and channels
+	// are logged with LogFunc. Zero means no limit.
+	MaxConnections           int
+	MaxConnectionsPerIP      int
+	MaxChannelsPerConnection int
+	// HandshakeTimeout limits the time for the ssh handshake including
+	// authentication. Zero means no limit.
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes connections without sftp requests being
+	// served for the duration since the last one. Traffic other than
+	// sftp requests, e.g. keepalives, does not keep connections open,
+	// and requests taking longer than the duration are not interrupted.
+	// Zero means no limit.
+	IdleTimeout time.Duration
 
 	readyChan chan error
-	connChan  chan net.Listener
+	readyOnce sync.Once
+
+	// mu protects the fields below, active counts the connections
+	// being handled.
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*activity
+	perIP     map[string]int
+	active    sync.WaitGroup
+	closed    bool
+	shutdown  bool
 }
 
+// ErrServerClosed is returned by RunServer and Serve after a call
+// to Close or Shutdown.
+var ErrServerClosed = errors.New("sftpd: Server closed")
+
 // Init inits a Config.
 func (c *Config) Init() {
 	c.readyChan = make(chan error, 1)
-	c.connChan = make(chan net.Listener, 1)
 }
 
-// RunServer runs the server using the high level API.
+// RunServer runs the server using the high level API
+// listening on HostPort.
 func (c *Config) RunServer() error {
-	if c.LogFunc == nil {
-		c.LogFunc = func(...interface{}) {}
-	}
-	e := runServer(c)
-	if e != nil {
-		c.LogFunc("sftpd server failed:", e)
-	}
-	return e
-}
-
-func runServer(c *Config) error {
 	listener, e := net.Listen("tcp", c.HostPort)
-	c.readyChan <- e
-	close(c.readyChan)
-	c.connChan <- listener
-	close(c.connChan)
 	if e != nil {
+		c.ready(e)
+		c.log("sftpd server failed:", e)
 		return e
 	}
+	return c.Serve(listener)
+}
 
+// Serve accepts connections on the listener and serves them until
+// the listener fails or the Config is closed. Can be called multiple
+// times in a concurrent fashion, e.g. for listening on several
+// addresses. The listener is closed when Serve returns.
+func (c *Config) Serve(listener net.Listener) error {
+	defer listener.Close()
+	if !c.trackListener(listener) {
+		c.ready(ErrServerClosed)
+		return ErrServerClosed
+	}
+	defer c.untrackListener(listener)
+	c.ready(nil)
 	for {
 		conn, e := listener.Accept()
 		if e != nil {
+			if c.isClosed() {
+				return ErrServerClosed
+			}
+			c.log("sftpd server failed:", e)
 			return e
 		}
 		go handleConn(conn, c)
 	}
 }
 
+// ready reports the result of starting to listen to BlockTillReady.
+func (c *Config) ready(e error) {
+	c.readyOnce.Do(func() {
+		if c.readyChan != nil {
+			c.readyChan <- e
+			close(c.readyChan)
+		}
+	})
+}
+
+func (c *Config) log(v ...interface{}) {
+	if c.LogFunc != nil {
+		c.LogFunc(v...)
+	}
+}
+
 func handleConn(conn net.Conn, config *Config) {
 	defer conn.Close()
-	e := doHandleConn(conn, config)
+	act, e := config.trackConn(conn)
 	if e != nil {
-		config.LogFunc("sftpd connection error:", e)
+		config.log("sftpd connection rejected:", conn.RemoteAddr(), e)
+		return
+	}
+	defer config.untrackConn(conn)
+	e = doHandleConn(conn, config, act)
+	if e != nil {
+		config.log("sftpd connection error:", e)
 	}
 }
 
-func doHandleConn(conn net.Conn, config *Config) error {
+func doHandleConn(conn net.Conn, config *Config, act *activity) error {
+	if config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
 	sc, chans, reqs, e := ssh.NewServerConn(conn, &config.ServerConfig)
 	if e != nil {
 		return e
 	}
+	conn.SetDeadline(time.Time{})
 	defer sc.Close()
+	if config.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go act.watchIdle(config.IdleTimeout, sc, done)
+	}
+	fs := config.ContextFileSystem
+	if fs == nil {
+		fs = ContextAdapter(config.FileSystem)
+	}
+	switch {
+	case config.ContextFileSystemFunc != nil:
+		connFS, e := config.ContextFileSystemFunc(sc, sc.Permissions)
+		if e != nil {
+			return e
+		}
+		if config.ReleaseContextFileSystem != nil {
+			defer config.ReleaseContextFileSystem(sc, connFS)
+		}
+		fs = connFS
+	case config.FileSystemFunc != nil:
+		connFS, e := config.FileSystemFunc(sc, sc.Permissions)
+		if e != nil {
+			return e
+		}
+		if config.ReleaseFileSystem != nil {
+			defer config.ReleaseFileSystem(sc, connFS)
+		}
+		fs = ContextAdapter(connFS)
+	}
+	ctx, cancel := context.WithCancel(withActivity(NewConnContext(context.Background(), sc, sc.Permissions), act))
+	// Channels end with the connection and are waited for before
+	// releasing the file system.
+	var wg sync.WaitGroup
+	defer func() {
+		sc.Close()
+		cancel()
+		wg.Wait()
+	}()
+	var channels int32
 
 	// The incoming Request channel must be serviced.
 	go printDiscardRequests(config, reqs)
@@ -90,16 +217,29 @@ func doHandleConn(conn net.Conn, config *Config) error {
 			return err
 		}
 
+		wg.Add(1)
 		go func(in <-chan *ssh.Request) {
+			defer wg.Done()
+			var served sync.WaitGroup
+			defer served.Wait()
 			for req := range in {
 				ok := false
 				switch {
 				case IsSftpRequest(req):
+					n := atomic.AddInt32(&channels, 1)
+					if config.MaxChannelsPerConnection > 0 && int(n) > config.MaxChannelsPerConnection {
+						atomic.AddInt32(&channels, -1)
+						config.log("sftpd channel rejected:", conn.RemoteAddr(), errTooManyChannels)
+						break
+					}
 					ok = true
+					served.Add(1)
 					go func() {
-						e := ServeChannel(channel, config.FileSystem)
+						defer served.Done()
+						defer atomic.AddInt32(&channels, -1)
+						e := config.Options.ServeChannelContext(ctx, channel, fs)
 						if e != nil {
-							config.LogFunc("sftpd servechannel failed:", e)
+							config.log("sftpd servechannel failed:", e)
 						}
 					}()
 				}
@@ -113,14 +253,15 @@ func doHandleConn(conn net.Conn, config *Config) error {
 
 func printDiscardRequests(c *Config, in <-chan *ssh.Request) {
 	for req := range in {
-		c.LogFunc("sftpd discarding ssh request", req.Type, *req)
+		c.log("sftpd discarding ssh request", req.Type, *req)
 		if req.WantReply {
 			req.Reply(false, nil)
 		}
 	}
 }
 
-// BlockTillReady will block till the Config is ready to accept connections.
+// BlockTillReady will block till the Config is ready to accept connections,
+// i.e. the first call of RunServer or Serve is listening.
 // Returns an error if listening failed. Can be called in a concurrent fashion.
 // This is new API - make sure Init is called on the Config before using it.
 func (c *Config) BlockTillReady() error {
@@ -128,12 +269,149 @@ func (c *Config) BlockTillReady() error {
 	return err
 }
 
-// Close closes the server assosiated with this config. Can be called in a concurrent
-// fashion.
-// This is new API - make sure Init is called on the Config before using it.
+// Close closes the listeners of all calls of RunServer and Serve,
+// including later ones, without closing active connections. Can be
+// called in a concurrent fashion.
 func (c *Config) Close() error {
-	for c := range c.connChan {
-		c.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for l := range c.listeners {
+		l.Close()
 	}
 	return nil
 }
+
+// Shutdown closes the Config like Close and closes the active
+// connections once they are idle, i.e. have no open handles and no
+// requests in flight, which lets open transfers complete. When ctx is
+// done the remaining connections and their open handles are closed
+// and the error of ctx is returned without waiting for them to end.
+// Can be called in a concurrent fashion.
+func (c *Config) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.shutdown = true
+	c.mu.Unlock()
+	c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		c.closeConns(false)
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			c.closeConns(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks for connections
+// becoming idle.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// closeConns closes the idle connections, or all of them and their
+// open handles if all is set.
+func (c *Config) closeConns(all bool) {
+	c.mu.Lock()
+	var acts []*activity
+	for conn, act := range c.conns {
+		if all || !act.busy() {
+			conn.Close()
+		}
+		if all {
+			acts = append(acts, act)
+		}
+	}
+	c.mu.Unlock()
+	for _, act := range acts {
+		act.closeHandles()
+	}
+}
+
+// trackListener adds a listener to the ones closed by Close unless
+// the Config has been closed.
+func (c *Config) trackListener(l net.Listener) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.listeners == nil {
+		c.listeners = map[net.Listener]struct{}{}
+	}
+	c.listeners[l] = struct{}{}
+	return true
+}
+
+func (c *Config) untrackListener(l net.Listener) {
+	c.mu.Lock()
+	delete(c.listeners, l)
+	c.mu.Unlock()
+}
+
+func (c *Config) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+var errTooManyConnections = errors.New("Too many connections")
+var errTooManyConnectionsPerIP = errors.New("Too many connections from the address")
+var errTooManyChannels = errors.New("Too many channels for the connection")
+
+// trackConn adds a connection to the active ones unless the server
+// is shutting down or a limit is reached. The returned activity tracks
+// the sftp requests of the connection.
+func (c *Config) trackConn(conn net.Conn) (*activity, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return nil, ErrServerClosed
+	}
+	if c.MaxConnections > 0 && len(c.conns) >= c.MaxConnections {
+		return nil, errTooManyConnections
+	}
+	ip := remoteIP(conn)
+	if c.MaxConnectionsPerIP > 0 && c.perIP[ip] >= c.MaxConnectionsPerIP {
+		return nil, errTooManyConnectionsPerIP
+	}
+	if c.conns == nil {
+		c.conns = map[net.Conn]*activity{}
+		c.perIP = map[string]int{}
+	}
+	act := newActivity()
+	c.conns[conn] = act
+	c.perIP[ip]++
+	c.active.Add(1)
+	return act, nil
+}
+
+func (c *Config) untrackConn(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	ip := remoteIP(conn)
+	if c.perIP[ip]--; c.perIP[ip] == 0 {
+		delete(c.perIP, ip)
+	}
+	c.mu.Unlock()
+	c.active.Done()
+}
+
+// remoteIP returns the address of the client without the port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,73 @@
+package sftpd
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NameResolver maps numeric user and group ids to names. An empty
+// name is returned for unknown ids.
+type NameResolver interface {
+	UserName(uid uint32) string
+	GroupName(gid uint32) string
+}
+
+// DefaultNameResolver is used when ServerOptions.NameResolver is nil.
+var DefaultNameResolver NameResolver = &PasswdResolver{PasswdFile: "/etc/passwd", GroupFile: "/etc/group"}
+
+// PasswdResolver is a NameResolver reading files in passwd(5)
+// and group(5) format. The files are read once on first use.
+type PasswdResolver struct {
+	PasswdFile string
+	GroupFile  string
+
+	once   sync.Once
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+// UserName returns the name of the user with the given uid.
+func (r *PasswdResolver) UserName(uid uint32) string {
+	r.once.Do(r.load)
+	return r.users[uid]
+}
+
+// GroupName returns the name of the group with the given gid.
+func (r *PasswdResolver) GroupName(gid uint32) string {
+	r.once.Do(r.load)
+	return r.groups[gid]
+}
+
+func (r *PasswdResolver) load() {
+	r.users = readIDFile(r.PasswdFile)
+	r.groups = readIDFile(r.GroupFile)
+}
+
+// readIDFile reads name:password:id lines ignoring errors.
+func readIDFile(fn string) map[uint32]string {
+	m := map[uint32]string{}
+	f, e := os.Open(fn)
+	if e != nil {
+		debug("reading", fn, "failed:", e)
+		return m
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fs := strings.SplitN(sc.Text(), ":", 4)
+		if len(fs) < 3 || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		id, e := strconv.ParseUint(fs[2], 10, 32)
+		if e != nil {
+			continue
+		}
+		if _, ok := m[uint32(id)]; !ok {
+			m[uint32(id)] = fs[0]
+		}
+	}
+	return m
+}
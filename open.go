@@ -0,0 +1,113 @@
+package sftpd
+
+import "github.com/taruti/binp"
+
+// parseOpen parses a SSH_FXP_OPEN request after the request id.
+func (s *session) parseOpen(p *binp.Parser, r *OpenRequest) *binp.Parser {
+	p = p.B32String(&r.Path)
+	if s.version < 5 {
+		var pflags uint32
+		p = s.parseAttr(p.B32(&pflags), &r.Attr)
+		r.decodeFlags3(pflags)
+		return p
+	}
+	p = s.parseAttr(p.B32(&r.Access).B32(&r.Flags), &r.Attr)
+	r.Read = r.Access&ace4_READ_DATA != 0
+	r.Write = r.Access&(ace4_WRITE_DATA|ace4_APPEND_DATA) != 0
+	r.Append = r.Flags&(ssh_FXF_APPEND_DATA|ssh_FXF_APPEND_DATA_ATOMIC) != 0
+	r.Disposition = r.Flags & ssh_FXF_ACCESS_DISPOSITION
+	r.Text = r.Flags&ssh_FXF_TEXT_MODE != 0
+	r.NoFollow = r.Flags&ssh_FXF_NOFOLLOW != 0
+	r.DeleteOnClose = r.Flags&ssh_FXF_DELETE_ON_CLOSE != 0
+	return p
+}
+
+func (r *OpenRequest) decodeFlags3(pflags uint32) {
+	r.pflags = pflags
+	r.Read = pflags&ssh_FXF_READ != 0
+	r.Write = pflags&ssh_FXF_WRITE != 0
+	r.Append = pflags&ssh_FXF_APPEND != 0
+	r.Text = pflags&ssh_FXF_TEXT != 0
+	switch {
+	case pflags&(ssh_FXF_CREAT|ssh_FXF_EXCL) == ssh_FXF_CREAT|ssh_FXF_EXCL:
+		r.Disposition = ssh_FXF_CREATE_NEW
+	case pflags&(ssh_FXF_CREAT|ssh_FXF_TRUNC) == ssh_FXF_CREAT|ssh_FXF_TRUNC:
+		r.Disposition = ssh_FXF_CREATE_TRUNCATE
+	case pflags&ssh_FXF_CREAT != 0:
+		r.Disposition = ssh_FXF_OPEN_OR_CREATE
+	case pflags&ssh_FXF_TRUNC != 0:
+		r.Disposition = ssh_FXF_TRUNCATE_EXISTING
+	default:
+		r.Disposition = ssh_FXF_OPEN_EXISTING
+	}
+	r.Flags = r.Disposition
+	if r.Read {
+		r.Access |= ace4_READ_DATA | ace4_READ_ATTRIBUTES
+	}
+	if r.Write {
+		r.Access |= ace4_WRITE_DATA | ace4_WRITE_ATTRIBUTES
+	}
+	if r.Append {
+		r.Access |= ace4_APPEND_DATA
+		r.Flags |= ssh_FXF_APPEND_DATA
+	}
+	if r.Text {
+		r.Flags |= ssh_FXF_TEXT_MODE
+	}
+}
+
+// flags3 returns the request as OPEN_* flags for FileSystem.OpenFile.
+// The flags of protocol version 3 and 4 requests are passed unchanged.
+func (r *OpenRequest) flags3() uint32 {
+	if r.pflags != 0 {
+		return r.pflags
+	}
+	var pflags uint32
+	if r.Read {
+		pflags |= ssh_FXF_READ
+	}
+	if r.Write {
+		pflags |= ssh_FXF_WRITE
+	}
+	if r.Append {
+		pflags |= ssh_FXF_APPEND
+	}
+	if r.Text {
+		pflags |= ssh_FXF_TEXT
+	}
+	switch r.Disposition {
+	case ssh_FXF_CREATE_NEW:
+		pflags |= ssh_FXF_CREAT | ssh_FXF_EXCL
+	case ssh_FXF_CREATE_TRUNCATE:
+		pflags |= ssh_FXF_CREAT | ssh_FXF_TRUNC
+	case ssh_FXF_OPEN_OR_CREATE:
+		pflags |= ssh_FXF_CREAT
+	case ssh_FXF_TRUNCATE_EXISTING:
+		pflags |= ssh_FXF_TRUNC
+	}
+	return pflags
+}
+
+// unsupportedFlags3 are the open flags of protocol version 5 and later
+// without an OPEN_* equivalent.
+const unsupportedFlags3 = ssh_FXF_NOFOLLOW | ssh_FXF_DELETE_ON_CLOSE |
+	ssh_FXF_BLOCK_READ | ssh_FXF_BLOCK_WRITE | ssh_FXF_BLOCK_DELETE | ssh_FXF_BLOCK_ADVISORY
+
+func openFile(fs FileSystem, r *OpenRequest) (File, error) {
+	if b, ok := fs.(*boundFS); ok {
+		if o, ok := b.fs.(ContextOpener); ok {
+			f, e := o.Open(b.ctx, r)
+			if e != nil {
+				return nil, e
+			}
+			return &boundFile{ctx: b.ctx, f: f}, nil
+		}
+	}
+	if o, ok := optional(fs).(Opener); ok {
+		return o.Open(r)
+	}
+	if r.NoFollow || r.DeleteOnClose || r.Flags&unsupportedFlags3 != 0 {
+		return nil, ErrUnsupported
+	}
+	return fs.OpenFile(r.Path, r.flags3(), &r.Attr)
+}
@@ -0,0 +1,178 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/taruti/binp"
+)
+
+// The OpenSSH protocol extensions are documented in the file PROTOCOL
+// of the OpenSSH sources.
+
+func posixRename(s *session, payload []byte) ([]byte, error) {
+	var oldpath, newpath string
+	e := binp.NewParser(payload).B32String(&oldpath).B32String(&newpath).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, s.fs.Rename(oldpath, newpath, RENAME_POSIX)
+}
+
+func hardlink(s *session, payload []byte) ([]byte, error) {
+	var oldpath, newpath string
+	e := binp.NewParser(payload).B32String(&oldpath).B32String(&newpath).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, s.fs.CreateLink(newpath, oldpath, LINK_HARD)
+}
+
+func fsync(s *session, payload []byte) ([]byte, error) {
+	var handle string
+	e := binp.NewParser(payload).B32String(&handle).End()
+	if e != nil {
+		return nil, e
+	}
+	f := s.h.getFile(handle)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	sf, ok := optional(f).(Syncer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return nil, sf.Sync()
+}
+
+func limits(s *session, payload []byte) ([]byte, error) {
+	o := binp.OutCap(4 * 8).B64(uint64(s.opts.MaxPacketLength)).B64(uint64(s.opts.MaxReadLength))
+	o.B64(uint64(s.opts.maxWriteLength())).B64(uint64(s.opts.MaxOpenHandles))
+	return o.Out(), nil
+}
+
+func supportsStatVFS(fs FileSystem) bool {
+	_, ok := optional(fs).(StatVFSer)
+	return ok
+}
+
+func statVFS(s *session, payload []byte) ([]byte, error) {
+	var path string
+	e := binp.NewParser(payload).B32String(&path).End()
+	if e != nil {
+		return nil, e
+	}
+	st, e := optional(s.fs).(StatVFSer).StatVFS(path)
+	return statVFSReply(st, e)
+}
+
+func fstatVFS(s *session, payload []byte) ([]byte, error) {
+	var handle string
+	e := binp.NewParser(payload).B32String(&handle).End()
+	if e != nil {
+		return nil, e
+	}
+	f := s.h.getFile(handle)
+	if f == nil {
+		return nil, errInvalidHandle
+	}
+	fst, ok := optional(f).(FStatVFSer)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	st, e := fst.FStatVFS()
+	return statVFSReply(st, e)
+}
+
+func statVFSReply(st *StatVFS, e error) ([]byte, error) {
+	if e != nil {
+		return nil, e
+	}
+	o := binp.OutCap(11 * 8).B64(st.BlockSize).B64(st.FragmentSize)
+	o.B64(st.Blocks).B64(st.BlocksFree).B64(st.BlocksAvail)
+	o.B64(st.Files).B64(st.FilesFree).B64(st.FilesAvail)
+	o.B64(st.FilesystemID).B64(st.Flags).B64(st.MaxNameLength)
+	return o.Out(), nil
+}
+
+func supportsLSetStat(fs FileSystem) bool {
+	_, ok := optional(fs).(LSetStater)
+	return ok
+}
+
+func lsetstat(s *session, payload []byte) ([]byte, error) {
+	var path string
+	var a Attr
+	e := s.parseAttr(binp.NewParser(payload).B32String(&path), &a).End()
+	if e != nil {
+		return nil, e
+	}
+	return nil, optional(s.fs).(LSetStater).LSetStat(path, &a)
+}
+
+var errInvalidIDList = errors.New("Invalid id list")
+
+func usersGroupsByID(s *session, payload []byte) ([]byte, error) {
+	var uids, gids string
+	e := binp.NewParser(payload).B32String(&uids).B32String(&gids).End()
+	if e != nil {
+		return nil, e
+	}
+	if len(uids)%4 != 0 || len(gids)%4 != 0 {
+		return nil, errInvalidIDList
+	}
+	users, groups := binp.Out(), binp.Out()
+	for i := 0; i < len(uids); i += 4 {
+		users.B32String(s.opts.NameResolver.UserName(binary.BigEndian.Uint32([]byte(uids[i : i+4]))))
+	}
+	for i := 0; i < len(gids); i += 4 {
+		groups.B32String(s.opts.NameResolver.GroupName(binary.BigEndian.Uint32([]byte(gids[i : i+4]))))
+	}
+	return binp.Out().B32String(string(users.Out())).B32String(string(groups.Out())).Out(), nil
+}
+
+func supportsHomeDir(fs FileSystem) bool {
+	_, ok := optional(fs).(HomeDirer)
+	return ok
+}
+
+func expandPath(s *session, payload []byte) ([]byte, error) {
+	var path string
+	e := binp.NewParser(payload).B32String(&path).End()
+	if e != nil {
+		return nil, e
+	}
+	if strings.HasPrefix(path, "~") {
+		user, rest := path[1:], ""
+		if i := strings.IndexByte(user, '/'); i >= 0 {
+			user, rest = user[:i], user[i+1:]
+		}
+		home, e := optional(s.fs).(HomeDirer).HomeDir(user)
+		if e != nil {
+			return nil, e
+		}
+		path = home
+		if rest != "" {
+			path = strings.TrimSuffix(home, "/") + "/" + rest
+		}
+	}
+	path, e = s.fs.RealPath(path)
+	if e != nil {
+		return nil, e
+	}
+	return s.nameOnly(path), nil
+}
+
+func homeDirectory(s *session, payload []byte) ([]byte, error) {
+	var user string
+	e := binp.NewParser(payload).B32String(&user).End()
+	if e != nil {
+		return nil, e
+	}
+	home, e := optional(s.fs).(HomeDirer).HomeDir(user)
+	if e != nil {
+		return nil, e
+	}
+	return s.nameOnly(home), nil
+}
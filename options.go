@@ -0,0 +1,107 @@
+package sftpd
+
+import (
+	"context"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ServerOptions contains per-server settings for serving channels.
+// The zero value is ready to use and uses the defaults for all fields.
+type ServerOptions struct {
+	// MaxPacketLength is the largest accepted packet from clients.
+	// Larger packets end the session. Defaults to 256 KiB like OpenSSH.
+	MaxPacketLength uint32
+	// MaxReadLength is the maximum amount of data returned for a single
+	// read request. Reads of more data are truncated. Defaults to 64 KiB.
+	MaxReadLength uint32
+	// MaxOpenHandles is the maximum number of open file and directory
+	// handles per channel. Defaults to 256.
+	MaxOpenHandles uint32
+	// NameResolver is used for the users-groups-by-id@openssh.com
+	// extension and for directory listings of entries without
+	// user and group names. Defaults to DefaultNameResolver.
+	NameResolver NameResolver
+	// MaxVersion is the highest protocol version negotiated with
+	// clients. Defaults to the highest supported version, 6.
+	MaxVersion uint32
+	// Workers is the number of requests of a channel processed
+	// concurrently. Requests for the same handle are always processed
+	// in order. Defaults to 1, which processes all requests in order.
+	Workers int
+	// Extensions are served in addition to the builtin extensions and
+	// take precedence over them. Of extensions with the same name the
+	// last one is used.
+	Extensions []Extension
+}
+
+const (
+	defaultMaxPacketLength = 256 * 1024
+	defaultMaxReadLength   = 64 * 1024
+	defaultMaxOpenHandles  = 0x100
+	maxVersion             = 6
+)
+
+// writeOverhead is the room left for the header of a SSH_FXP_WRITE
+// packet when advertising the maximum write length.
+const writeOverhead = 1024
+
+func (o *ServerOptions) withDefaults() ServerOptions {
+	var opts ServerOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.MaxPacketLength == 0 {
+		opts.MaxPacketLength = defaultMaxPacketLength
+	}
+	if opts.MaxReadLength == 0 {
+		opts.MaxReadLength = defaultMaxReadLength
+	}
+	if opts.MaxOpenHandles == 0 {
+		opts.MaxOpenHandles = defaultMaxOpenHandles
+	}
+	if opts.MaxVersion == 0 || opts.MaxVersion > maxVersion {
+		opts.MaxVersion = maxVersion
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.NameResolver == nil {
+		opts.NameResolver = DefaultNameResolver
+	}
+	return opts
+}
+
+// negotiateVersion picks the protocol version for a client. Clients
+// older than version 3 are served version 3 like before.
+func negotiateVersion(client, max uint32) uint32 {
+	v := client
+	if v > max {
+		v = max
+	}
+	if v < 3 {
+		v = 3
+	}
+	return v
+}
+
+func (o *ServerOptions) maxWriteLength() uint32 {
+	if o.MaxPacketLength <= 2*writeOverhead {
+		return o.MaxPacketLength / 2
+	}
+	return o.MaxPacketLength - writeOverhead
+}
+
+// ServeChannel serves a ssh.Channel with the given FileSystem using
+// the default ServerOptions.
+func ServeChannel(c ssh.Channel, fs FileSystem) error {
+	var o ServerOptions
+	return o.ServeChannel(c, fs)
+}
+
+// ServeChannelContext serves a ssh.Channel with the given ContextFileSystem
+// using the default ServerOptions.
+func ServeChannelContext(ctx context.Context, c ssh.Channel, fs ContextFileSystem) error {
+	var o ServerOptions
+	return o.ServeChannelContext(ctx, c, fs)
+}
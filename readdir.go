@@ -2,20 +2,38 @@ package sftpd
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 )
 
-func readdirLongName(fi *NamedAttr) string {
+func readdirLongName(fi *NamedAttr, r NameResolver) string {
+	user, group := fi.User, fi.Group
+	if fi.Flags&ATTR_UIDGID != 0 {
+		if user == "" {
+			user = idName(r.UserName(fi.Uid), fi.Uid)
+		}
+		if group == "" {
+			group = idName(r.GroupName(fi.Gid), fi.Gid)
+		}
+	}
 	return fmt.Sprintf("%10s %3d %-8s %-8s %8d %12s %s",
 		fi.Mode.String(),
 		1, // links
-		fi.User, fi.Group,
+		user, group,
 		fi.Size,
 		readdirTimeFormat(fi.MTime),
 		fi.Name,
 	)
 }
 
+// idName falls back to the numeric id like ls(1) for unknown names.
+func idName(name string, id uint32) string {
+	if name == "" {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	return name
+}
+
 func readdirTimeFormat(t time.Time) string {
 	// We return timestamps in UTC, should we offer a customisation point for users?
 	if t.Year() == time.Now().Year() {
@@ -0,0 +1,91 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrNotSequential is returned by files created with NewSequentialFile
+// when a client accesses them out of order. It is sent to the client as
+// SSH_FX_OP_UNSUPPORTED.
+var ErrNotSequential = errors.New("Non-sequential access to a sequential file")
+
+// NewSequentialFile returns a File for backends that can only be read
+// or written in order, like pipes or compressed archives. Reads are
+// passed to rw if it implements io.Reader and writes if it implements
+// io.Writer. FStat and FSetStat are passed on if rw implements them.
+//
+// Clients pipeline requests in order, and requests for the same handle
+// are always served in order, so plain downloads and uploads work.
+// Requests at other offsets fail with ErrNotSequential, reads after the
+// end of the data with io.EOF.
+func NewSequentialFile(rw io.Closer) File {
+	return &sequentialFile{rw: rw}
+}
+
+type sequentialFile struct {
+	mu     sync.Mutex
+	rw     io.Closer
+	offset int64
+	eof    bool
+}
+
+func (f *sequentialFile) Close() error { return f.rw.Close() }
+
+func (f *sequentialFile) ReadAt(bs []byte, offset int64) (int, error) {
+	r, ok := f.rw.(io.Reader)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.eof && offset >= f.offset {
+		return 0, io.EOF
+	}
+	if offset != f.offset {
+		return 0, ErrNotSequential
+	}
+	// Short reads before the end would make the next request of the
+	// client be out of order, so the buffer is filled.
+	n, e := io.ReadFull(r, bs)
+	f.offset += int64(n)
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		f.eof = true
+		e = io.EOF
+	}
+	return n, e
+}
+
+func (f *sequentialFile) WriteAt(bs []byte, offset int64) (int, error) {
+	w, ok := f.rw.(io.Writer)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if offset != f.offset {
+		return 0, ErrNotSequential
+	}
+	n, e := w.Write(bs)
+	f.offset += int64(n)
+	return n, e
+}
+
+func (f *sequentialFile) FStat() (*Attr, error) {
+	if st, ok := f.rw.(interface {
+		FStat() (*Attr, error)
+	}); ok {
+		return st.FStat()
+	}
+	return &Attr{}, nil
+}
+
+func (f *sequentialFile) FSetStat(a *Attr) error {
+	if st, ok := f.rw.(interface {
+		FSetStat(*Attr) error
+	}); ok {
+		return st.FSetStat(a)
+	}
+	return ErrUnsupported
+}
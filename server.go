@@ -3,11 +3,13 @@ package sftpd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/taruti/binp"
@@ -22,267 +24,445 @@ func IsSftpRequest(req *ssh.Request) bool {
 	return req.Type == "subsystem" && bytes.Equal(sftpSubSystem, req.Payload)
 }
 
-var initReply = []byte{0, 0, 0, 5, ssh_FXP_VERSION, 0, 0, 0, 3}
+// session contains the state of a single channel being served.
+type session struct {
+	fs   FileSystem
+	opts *ServerOptions
+	h    *handles
+	// act tracks the requests for a Config, nil otherwise.
+	act *activity
+	// version is the negotiated protocol version.
+	version uint32
+}
 
 // ServeChannel serves a ssh.Channel with the given FileSystem.
-func ServeChannel(c ssh.Channel, fs FileSystem) error {
+func (o *ServerOptions) ServeChannel(c ssh.Channel, fs FileSystem) error {
+	return o.serveChannel(c, fs, nil, nil)
+}
+
+// ServeChannelContext serves a ssh.Channel with the given ContextFileSystem.
+// The context passed to fs is derived from ctx and cancelled when the
+// channel is closed. Cancelling ctx closes the channel.
+func (o *ServerOptions) ServeChannelContext(ctx context.Context, c ssh.Channel, fs ContextFileSystem) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-parent.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return o.serveChannel(c, bindContext(ctx, fs), cancel, activityFromContext(ctx))
+}
+
+// serveChannel serves a channel. If cancel is non-nil requests are
+// read from the channel concurrently with serving them, and cancel is
+// called when reading ends, e.g. because the channel was closed.
+// The requests are tracked by act if non-nil.
+func (o *ServerOptions) serveChannel(c ssh.Channel, fs FileSystem, cancel func(), act *activity) error {
 	defer c.Close()
+	opts := o.withDefaults()
 	var h handles
 	h.init()
 	defer h.closeAll()
-	brd := bufio.NewReaderSize(c, 64*1024)
+	act.addSession(&h)
+	defer act.removeSession(&h)
+	s := &session{fs: fs, opts: &opts, h: &h, act: act, version: 3}
+	if opts.Workers <= 1 && cancel == nil {
+		return s.serve(c, nil)
+	}
+	c = &lockedChannel{Channel: c}
+	w := newWorkers(s, c)
+	e := s.serve(c, w)
+	// Requests still being served are abandoned by cancelling their
+	// context, the replies are sent before the channel is closed.
+	if cancel != nil {
+		cancel()
+	}
+	if we := w.wait(); we != nil {
+		e = we
+	}
+	return e
+}
+
+// serve reads requests from the channel. They are served by the workers
+// if w is non-nil and otherwise one at a time.
+func (s *session) serve(c ssh.Channel, w *workers) error {
+	brd := bufio.NewReaderSize(c, readBufferSize)
 	var e error
 	var plen int
 	var op byte
 	var bs []byte
-	var id uint32
+	// The version is only negotiated before other requests, which
+	// workers may be serving already.
+	var started bool
 	for {
-		if e != nil {
-			debug("Sending error", e)
-			e = writeErr(c, id, e)
-			if e != nil {
-				return e
-			}
-		}
 		discard(brd, plen)
 		plen, op, e = readPacketHeader(brd)
 		if e != nil {
 			return e
 		}
+		if op == ssh_FXP_INIT && started {
+			return errLateInit
+		}
+		started = true
+		if plen > int(s.opts.MaxPacketLength) {
+			return errPacketTooLong
+		}
 		plen--
 		debugf("CR op=%v data len=%d\n", ssh_fxp(op), plen)
 		if plen < 2 {
 			return errors.New("Packet too short")
 		}
-		// Feeding too large values to peek is ok, it just errors.
-		bs, e = brd.Peek(plen)
+		// Packets fitting the read buffer are served from it without
+		// copying, larger ones are read into a buffer of their own.
+		var large bool
+		if plen <= brd.Size() {
+			bs, e = brd.Peek(plen)
+		} else {
+			large = true
+			bs = bytepool.Alloc(plen)
+			_, e = io.ReadFull(brd, bs)
+			plen = 0
+		}
 		if e != nil {
 			return e
 		}
 		debugf("Data %X\n", bs)
-		p := binp.NewParser(bs)
-		switch op {
-		case ssh_FXP_INIT:
-			e = wrc(c, initReply)
-		case ssh_FXP_OPEN:
-			var path string
-			var flags uint32
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&path).B32(&flags), &a).End()
-			if e != nil {
-				return e
-			}
-			if h.nfiles() >= maxFiles {
-				e = errTooManyFiles
-				continue
-			}
-			var f File
-			f, e = fs.OpenFile(path, flags, &a)
-			if e != nil {
-				continue
-			}
-			e = writeHandle(c, id, h.newFile(f))
-		case ssh_FXP_CLOSE:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			h.closeHandle(handle)
-			e = writeErr(c, id, nil)
-		case ssh_FXP_READ:
-			var handle string
-			var offset uint64
-			var length uint32
-			var n int
-			e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
-			if e != nil {
-				return e
-			}
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			if length > 64*1024 {
-				length = 64 * 1024
-			}
-			bs := bytepool.Alloc(int(length))
-			n, e = f.ReadAt(bs, int64(offset))
-			// Handle go readers that return io.EOF and bytes at the same time.
-			if e == io.EOF && n > 0 {
-				e = nil
-			}
-			if e != nil {
-				bytepool.Free(bs)
-				continue
-			}
-			bs = bs[0:n]
-			e = wrc(c, binp.Out().B32(1+4+4+uint32(len(bs))).Byte(ssh_FXP_DATA).B32(id).B32(uint32(len(bs))).Out())
-			if e == nil {
-				e = wrc(c, bs)
-			}
+		s.act.begin()
+		if w != nil && op != ssh_FXP_INIT {
+			w.dispatch(op, bs)
+		} else {
+			e = s.serveRequest(c, op, bs)
+			s.act.end()
+		}
+		if large {
 			bytepool.Free(bs)
-		case ssh_FXP_WRITE:
-			var handle string
-			var offset uint64
-			var length uint32
-			p.B32(&id).B32String(&handle).B64(&offset).B32(&length)
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			var bs []byte
-			e = p.NBytesPeek(int(length), &bs).End()
-			if e != nil {
-				return e
-			}
-			_, e = f.WriteAt(bs, int64(offset))
-			e = writeErr(c, id, e)
-		case ssh_FXP_LSTAT, ssh_FXP_STAT:
-			var path string
-			var a *Attr
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			a, e = fs.Stat(path, op == ssh_FXP_LSTAT)
-			debug("stat/lstat", path, "=>", a, e)
-			e = writeAttr(c, id, a, e)
-		case ssh_FXP_FSTAT:
-			var handle string
-			var a *Attr
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			a, e = f.FStat()
-			e = writeAttr(c, id, a, e)
-		case ssh_FXP_SETSTAT:
-			var path string
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&path), &a).End()
-			if e != nil {
-				return e
-			}
-			e = writeErr(c, id, fs.SetStat(path, &a))
-		case ssh_FXP_FSETSTAT:
-			var handle string
-			var a Attr
-			e = parseAttr(p.B32(&id).B32String(&handle), &a).End()
-			if e != nil {
-				return e
-			}
-			f := h.getFile(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			e = writeErr(c, id, f.FSetStat(&a))
-		case ssh_FXP_OPENDIR:
-			var path string
-			var dh Dir
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			dh, e = fs.OpenDir(path)
-			debug("opendir", id, path, "=>", dh, e)
-			if e != nil {
-				continue
-			}
-			e = writeHandle(c, id, h.newDir(dh))
+		}
+		if e != nil {
+			return e
+		}
+	}
+}
 
-		case ssh_FXP_READDIR:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				return e
-			}
-			f := h.getDir(handle)
-			if f == nil {
-				return errInvalidHandle
-			}
-			var fis []NamedAttr
-			fis, e = f.Readdir(1024)
-			debug("readdir", id, handle, fis, e)
-			if e != nil {
-				continue
-			}
-			var l binp.Len
-			o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(uint32(len(fis)))
-			for _, fi := range fis {
-				n := fi.Name
-				o.B32String(n).B32String(readdirLongName(&fi)).B32(fi.Flags)
-				if fi.Flags&ATTR_SIZE != 0 {
-					o.B64(uint64(fi.Size))
-				}
-				if fi.Flags&ATTR_UIDGID != 0 {
-					o.B32(fi.Uid).B32(fi.Gid)
-				}
-				if fi.Flags&ATTR_MODE != 0 {
-					o.B32(fileModeToSftp(fi.Mode))
-				}
-				if fi.Flags&ATTR_TIME != 0 {
-					outTimes(o, &fi.Attr)
-				}
-			}
-			o.LenDone(&l)
-			e = wrc(c, o.Out())
+// readBufferSize is the size of the buffer for reading requests.
+const readBufferSize = 64 * 1024
 
-		case ssh_FXP_REMOVE:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
-			}
-			e = writeErr(c, id, fs.Remove(path))
-		case ssh_FXP_MKDIR:
-			var path string
-			var a Attr
-			p = p.B32(&id).B32String(&path)
-			e = parseAttr(p, &a).End()
-			if e != nil {
-				return e
-			}
-			e = writeErr(c, id, fs.Mkdir(path, &a))
-		case ssh_FXP_RMDIR:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				return e
+// serveRequest serves a single request packet. Failures of the request
+// are sent to the client, only errors ending the session are returned.
+func (s *session) serveRequest(c ssh.Channel, op byte, bs []byte) error {
+	var e error
+	var id uint32
+	p := binp.NewParser(bs)
+	switch op {
+	case ssh_FXP_INIT:
+		// The version may be followed by extension pairs.
+		var version uint32
+		if p.B32(&version) == nil {
+			return errors.New("Packet too short")
+		}
+		s.version = negotiateVersion(version, s.opts.MaxVersion)
+		e = writeVersion(c, s)
+	case ssh_FXP_OPEN:
+		var r OpenRequest
+		e = s.parseOpen(p.B32(&id), &r).End()
+		if e != nil {
+			return e
+		}
+		if s.h.count() >= int(s.opts.MaxOpenHandles) {
+			return s.writeErr(c, id, errTooManyFiles)
+		}
+		var f File
+		f, e = openFile(s.fs, &r)
+		if e != nil {
+			return s.writeErr(c, id, e)
+		}
+		e = writeHandle(c, id, s.h.newFile(f))
+	case ssh_FXP_CLOSE:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			return e
+		}
+		s.h.closeHandle(handle)
+		e = s.writeErr(c, id, nil)
+	case ssh_FXP_READ:
+		var handle string
+		var offset uint64
+		var length uint32
+		var n int
+		e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getFile(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		if length > s.opts.MaxReadLength {
+			length = s.opts.MaxReadLength
+		}
+		// The data is read after room for the header so that the reply
+		// is sent with a single write.
+		bs := bytepool.Alloc(dataHeaderLength + int(length))
+		n, e = f.ReadAt(bs[dataHeaderLength:], int64(offset))
+		// Handle go readers that return io.EOF and bytes at the same time.
+		if e == io.EOF && n > 0 {
+			e = nil
+		}
+		if e != nil {
+			bytepool.Free(bs)
+			return s.writeErr(c, id, e)
+		}
+		bs = bs[0 : dataHeaderLength+n]
+		binary.BigEndian.PutUint32(bs, uint32(1+4+4+n))
+		bs[4] = ssh_FXP_DATA
+		binary.BigEndian.PutUint32(bs[5:], id)
+		binary.BigEndian.PutUint32(bs[9:], uint32(n))
+		e = wrc(c, bs)
+		bytepool.Free(bs)
+	case ssh_FXP_WRITE:
+		var handle string
+		var offset uint64
+		var length uint32
+		var bs []byte
+		e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).NBytesPeek(int(length), &bs).End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getFile(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		_, e = f.WriteAt(bs, int64(offset))
+		e = s.writeErr(c, id, e)
+	case ssh_FXP_LSTAT, ssh_FXP_STAT:
+		var path string
+		var a *Attr
+		e = s.parseStatFlags(p.B32(&id).B32String(&path)).End()
+		if e != nil {
+			return e
+		}
+		a, e = s.fs.Stat(path, op == ssh_FXP_LSTAT)
+		debug("stat/lstat", path, "=>", a, e)
+		e = s.writeAttr(c, id, a, e)
+	case ssh_FXP_FSTAT:
+		var handle string
+		var a *Attr
+		e = s.parseStatFlags(p.B32(&id).B32String(&handle)).End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getFile(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		a, e = f.FStat()
+		e = s.writeAttr(c, id, a, e)
+	case ssh_FXP_SETSTAT:
+		var path string
+		var a Attr
+		e = s.parseAttr(p.B32(&id).B32String(&path), &a).End()
+		if e != nil {
+			return e
+		}
+		e = s.writeErr(c, id, s.fs.SetStat(path, &a))
+	case ssh_FXP_FSETSTAT:
+		var handle string
+		var a Attr
+		e = s.parseAttr(p.B32(&id).B32String(&handle), &a).End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getFile(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		e = s.writeErr(c, id, f.FSetStat(&a))
+	case ssh_FXP_OPENDIR:
+		var path string
+		var dh Dir
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return e
+		}
+		if s.h.count() >= int(s.opts.MaxOpenHandles) {
+			return s.writeErr(c, id, errTooManyFiles)
+		}
+		dh, e = s.fs.OpenDir(path)
+		debug("opendir", id, path, "=>", dh, e)
+		if e != nil {
+			return s.writeErr(c, id, e)
+		}
+		e = writeHandle(c, id, s.h.newDir(dh))
+
+	case ssh_FXP_READDIR:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getDir(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		var fis []NamedAttr
+		fis, e = f.Readdir(1024)
+		debug("readdir", id, handle, fis, e)
+		if e != nil {
+			return s.writeErr(c, id, e)
+		}
+		var l binp.Len
+		o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(uint32(len(fis)))
+		for _, fi := range fis {
+			o.B32String(fi.Name)
+			if s.version < 4 {
+				o.B32String(readdirLongName(&fi, s.opts.NameResolver))
 			}
-			e = writeErr(c, id, fs.Rmdir(path))
-		case ssh_FXP_REALPATH:
-			var path, newpath string
-			p.B32(&id).B32String(&path).End()
-			newpath, e = fs.RealPath(path)
-			debug("realpath: mapping", path, "=>", newpath, e)
-			e = writeNameOnly(c, id, newpath, e)
-		case ssh_FXP_RENAME:
-			debug("FIXME RENAME NOT SUPPORTED")
-			e = writeFail(c, id) // FIXME
-		case ssh_FXP_READLINK:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			path, e = fs.ReadLink(path)
-			e = writeNameOnly(c, id, path, e)
-		case ssh_FXP_SYMLINK:
-			debug("FIXME SYMLINK NOT SUPPORTED")
-			e = writeFail(c, id) // FIXME
+			s.outAttr(o, &fi.Attr)
+		}
+		o.LenDone(&l)
+		e = wrc(c, o.Out())
+
+	case ssh_FXP_REMOVE:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			return e
+		}
+		e = s.writeErr(c, id, s.fs.Remove(path))
+	case ssh_FXP_MKDIR:
+		var path string
+		var a Attr
+		p = p.B32(&id).B32String(&path)
+		e = s.parseAttr(p, &a).End()
+		if e != nil {
+			return e
 		}
+		e = s.writeErr(c, id, s.fs.Mkdir(path, &a))
+	case ssh_FXP_RMDIR:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
 		if e != nil {
 			return e
 		}
+		e = s.writeErr(c, id, s.fs.Rmdir(path))
+	case ssh_FXP_REALPATH:
+		e = s.realPath(c, p, &id, len(bs))
+	case ssh_FXP_RENAME:
+		var oldpath, newpath string
+		var flags uint32
+		p = p.B32(&id).B32String(&oldpath).B32String(&newpath)
+		if s.version >= 5 {
+			p = p.B32(&flags)
+		}
+		e = p.End()
+		if e != nil {
+			return e
+		}
+		e = s.writeErr(c, id, s.fs.Rename(oldpath, newpath, flags))
+	case ssh_FXP_READLINK:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		path, e = s.fs.ReadLink(path)
+		e = s.writeNameOnly(c, id, path, e)
+	case ssh_FXP_SYMLINK:
+		// The draft specifies linkpath before targetpath, but OpenSSH
+		// swapped them and version 3 clients follow OpenSSH, which
+		// speaks no later version.
+		var linkpath, target string
+		if s.version < 4 {
+			p = p.B32(&id).B32String(&target).B32String(&linkpath)
+		} else {
+			p = p.B32(&id).B32String(&linkpath).B32String(&target)
+		}
+		e = p.End()
+		if e != nil {
+			return e
+		}
+		e = s.writeErr(c, id, s.fs.CreateLink(linkpath, target, LINK_SYMBOLIC))
+	case ssh_FXP_LINK:
+		var linkpath, target string
+		var symlink []byte
+		e = p.B32(&id).B32String(&linkpath).B32String(&target).NBytesPeek(1, &symlink).End()
+		if e != nil {
+			return e
+		}
+		var kind uint32 = LINK_HARD
+		if symlink[0] != 0 {
+			kind = LINK_SYMBOLIC
+		}
+		e = s.writeErr(c, id, s.fs.CreateLink(linkpath, target, kind))
+	case ssh_FXP_BLOCK, ssh_FXP_UNBLOCK:
+		var handle string
+		var offset, length uint64
+		var mask uint32
+		p = p.B32(&id).B32String(&handle).B64(&offset).B64(&length)
+		if op == ssh_FXP_BLOCK {
+			p = p.B32(&mask)
+		}
+		e = p.End()
+		if e != nil {
+			return e
+		}
+		f := s.h.getFile(handle)
+		if f == nil {
+			return s.writeErr(c, id, errInvalidHandle)
+		}
+		b, ok := optional(f).(Blocker)
+		if !ok {
+			return s.writeErr(c, id, ErrUnsupported)
+		}
+		if op == ssh_FXP_BLOCK {
+			e = b.Block(offset, length, mask)
+		} else {
+			e = b.Unblock(offset, length)
+		}
+		e = s.writeErr(c, id, e)
+	case ssh_FXP_EXTENDED:
+		var name string
+		var payload, reply []byte
+		p = p.B32(&id).B32String(&name)
+		if p != nil {
+			p = p.NBytesPeek(len(bs)-4-4-len(name), &payload)
+		}
+		e = p.End()
+		if e != nil {
+			return e
+		}
+		var typ byte
+		typ, reply, e = callExtension(s, name, payload)
+		debug("extended", name, "=>", reply, e)
+		if e != nil {
+			return s.writeErr(c, id, e)
+		}
+		if reply == nil {
+			e = s.writeErr(c, id, nil)
+		} else {
+			e = writeReply(c, typ, id, reply)
+		}
+	default:
+		if len(bs) < 4 {
+			return errors.New("Packet too short")
+		}
+		id = binary.BigEndian.Uint32(bs)
+		e = s.writeErr(c, id, ErrUnsupported)
 	}
+	return e
 }
 
+// dataHeaderLength is the length of a SSH_FXP_DATA packet without the data.
+const dataHeaderLength = 4 + 1 + 4 + 4
+
 var errInvalidHandle = errors.New("Client supplied an invalid handle")
 var errTooManyFiles = errors.New("Too many files")
-
-const maxFiles = 0x100
+var errPacketTooLong = errors.New("Packet too long")
+var errCopyOverlap = errors.New("Overlapping copy within a file")
+var errLateInit = errors.New("SSH_FXP_INIT after other requests")
 
 func readPacketHeader(rd *bufio.Reader) (int, byte, error) {
 	bs := make([]byte, 5)
@@ -310,89 +490,134 @@ func parseAttr(p *binp.Parser, a *Attr) *binp.Parser {
 		p = inTimes(p, a)
 	}
 	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
-		var count uint32
-		p = p.B32(&count)
-		if count > 0xFF {
-			return nil
-		}
-		ss := make([]string, 2*int(count))
-		for i := 0; i < int(count); i++ {
-			var k, v string
-			p = p.B32String(&k).B32String(&v)
-			ss[2*i+0] = k
-			ss[2*i+1] = v
-		}
-		a.Extended = ss
+		p = parseExtended(p, a)
+	}
+	a.Flags &= attrFlags3
+	return p
+}
+
+func parseExtended(p *binp.Parser, a *Attr) *binp.Parser {
+	var count uint32
+	p = p.B32(&count)
+	if count > 0xFF {
+		return nil
+	}
+	ss := make([]string, 2*int(count))
+	for i := 0; i < int(count); i++ {
+		var k, v string
+		p = p.B32String(&k).B32String(&v)
+		ss[2*i+0] = k
+		ss[2*i+1] = v
 	}
+	a.Extended = ss
 	return p
 }
 
-func writeAttr(c ssh.Channel, id uint32, a *Attr, e error) error {
+func (s *session) writeAttr(c ssh.Channel, id uint32, a *Attr, e error) error {
 	if e != nil {
-		return writeErr(c, id, e)
+		return s.writeErr(c, id, e)
 	}
 	var l binp.Len
-	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_ATTRS).B32(id).B32(a.Flags)
-	if a.Flags&ssh_FILEXFER_ATTR_SIZE != 0 {
-		o = o.B64(a.Size)
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_ATTRS).B32(id)
+	s.outAttr(o, a)
+	o.LenDone(&l)
+	return wrc(c, o.Out())
+}
+
+func outAttr3(o *binp.Printer, a *Attr) {
+	flags := a.Flags & attrFlags3
+	o.B32(flags)
+	if flags&ssh_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
-		o = o.B32(a.Uid).B32(a.Gid)
+	if flags&ssh_FILEXFER_ATTR_UIDGID != 0 {
+		o.B32(a.Uid).B32(a.Gid)
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
-		o = o.B32(fileModeToSftp(a.Mode))
+	if flags&ssh_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
+	if flags&ssh_FILEXFER_ATTR_ACMODTIME != 0 {
 		outTimes(o, a)
 	}
-	if a.Flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
-		count := uint32(len(a.Extended) / 2)
-		o = o.B32(count)
-		for _, s := range a.Extended {
-			o = o.B32String(s)
-		}
+	if flags&ssh_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func outExtended(o *binp.Printer, a *Attr) {
+	count := uint32(len(a.Extended) / 2)
+	o.B32(count)
+	for _, s := range a.Extended[:2*count] {
+		o.B32String(s)
 	}
-	o.LenDone(&l)
-	return wrc(c, o.Out())
 }
 
-func writeNameOnly(c ssh.Channel, id uint32, path string, e error) error {
+func (s *session) writeNameOnly(c ssh.Channel, id uint32, path string, e error) error {
 	if e != nil {
-		return writeErr(c, id, e)
+		return s.writeErr(c, id, e)
 	}
-	var l binp.Len
-	o := binp.Out().LenB32(&l).LenStart(&l).Byte(ssh_FXP_NAME).B32(id).B32(1)
-	o.B32String(path).B32String(path).B32(0)
-	o.LenDone(&l)
-	return wrc(c, o.Out())
+	return writeReply(c, ssh_FXP_NAME, id, s.nameOnly(path))
 }
 
-var failTmpl = []byte{0, 0, 0, 1 + 4 + 4 + 4 + 4, ssh_FXP_STATUS, 0, 0, 0, 0, 0, 0, 0, ssh_FX_FAILURE, 0, 0, 0, 0, 0, 0, 0, 0}
+// realPath serves SSH_FXP_REALPATH. Version 6 clients may send
+// a control byte and paths to compose with the original path.
+func (s *session) realPath(c ssh.Channel, p *binp.Parser, id *uint32, plen int) error {
+	var path, compose string
+	var control []byte
+	p = p.B32(id).B32String(&path)
+	rest := plen - 4 - 4 - len(path)
+	if s.version >= 6 && rest > 0 {
+		p = p.NBytesPeek(1, &control)
+		rest--
+		for p != nil && rest > 0 {
+			p = p.B32String(&compose)
+			rest -= 4 + len(compose)
+			if strings.HasPrefix(compose, "/") {
+				path = compose
+			} else {
+				path = strings.TrimSuffix(path, "/") + "/" + compose
+			}
+		}
+	}
+	e := p.End()
+	if e != nil {
+		return e
+	}
+	newpath, e := s.fs.RealPath(path)
+	debug("realpath: mapping", path, "=>", newpath, e)
+	if e != nil || control == nil || control[0] == ssh_FXP_REALPATH_NO_CHECK {
+		return s.writeNameOnly(c, *id, newpath, e)
+	}
+	a, e := s.fs.Stat(newpath, false)
+	if e != nil && (control[0] == ssh_FXP_REALPATH_STAT_ALWAYS || !os.IsNotExist(e)) {
+		return s.writeErr(c, *id, e)
+	}
+	if e != nil {
+		return s.writeNameOnly(c, *id, newpath, nil)
+	}
+	o := binp.Out().B32(1).B32String(newpath)
+	s.outAttr(o, a)
+	return writeReply(c, ssh_FXP_NAME, *id, o.Out())
+}
 
-func writeFail(c ssh.Channel, id uint32) error {
-	bs := make([]byte, len(failTmpl))
-	copy(bs, failTmpl)
-	binary.BigEndian.PutUint32(bs[5:], id)
-	return wrc(c, bs)
+// nameOnly returns the body of a SSH_FXP_NAME packet with a single path
+// without attributes.
+func (s *session) nameOnly(path string) []byte {
+	o := binp.Out().B32(1).B32String(path)
+	if s.version < 4 {
+		o.B32String(path)
+	}
+	s.outAttr(o, &Attr{})
+	return o.Out()
 }
 
-func writeErr(c ssh.Channel, id uint32, err error) error {
+var failTmpl = []byte{0, 0, 0, 1 + 4 + 4 + 4 + 4, ssh_FXP_STATUS, 0, 0, 0, 0, 0, 0, 0, ssh_FX_FAILURE, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func (s *session) writeErr(c ssh.Channel, id uint32, err error) error {
 	bs := make([]byte, len(failTmpl))
 	copy(bs, failTmpl)
 	binary.BigEndian.PutUint32(bs[5:], id)
-	var code ssh_fx
-	switch {
-	case err == nil:
-		code = ssh_FX_OK
-	case err == io.EOF:
-		code = ssh_FX_EOF
-	case os.IsPermission(err):
-		code = ssh_FX_PERMISSION_DENIED
-	case os.IsNotExist(err):
-		code = ssh_FX_NO_SUCH_FILE
-	default:
-		code = ssh_FX_FAILURE
-	}
+	code := statusCode(err, s.version)
 	debug("Sending sftp error code", code)
 	bs[12] = byte(code)
 	return wrc(c, bs)
@@ -1,15 +1,25 @@
 package sftpd
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	client "github.com/pkg/sftp"
+	"github.com/taruti/binp"
 	"github.com/taruti/sshutil"
 	"golang.org/x/crypto/ssh"
 )
@@ -153,6 +163,1425 @@ func clientDo() error {
 	return nil
 }
 
+// runClientTest serves fs on a random local port and runs f with a
+// pkg/sftp client connected to it.
+func runClientTest(t *testing.T, fs FileSystem, f func(cl *client.Client) error) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: sshutil.CreatePasswordCheck(testUser, testPass),
+	}
+	hkey, e := sshutil.KeyLoader{Flags: sshutil.Create}.Load()
+	failOnErr(t, e, "Failed to parse host key")
+	config.AddHostKey(hkey)
+
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, e, "Failed to listen")
+	defer listener.Close()
+
+	go func() {
+		nConn, e := listener.Accept()
+		if e != nil {
+			return
+		}
+		handleTestConn(nConn, config, t, fs)
+	}()
+
+	conn, cl := dialTestClient(t, listener.Addr().String())
+	defer conn.Close()
+	defer cl.Close()
+	failOnErr(t, f(cl), "Client failed")
+}
+
+func dialTestClient(t *testing.T, addr string) (*ssh.Client, *client.Client) {
+	var cc ssh.ClientConfig
+	cc.User = string(testUser)
+	cc.Auth = append(cc.Auth, ssh.Password(string(testPass)))
+	// Use this only for localhost testing.
+	cc.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	conn, e := ssh.Dial("tcp4", addr, &cc)
+	failOnErr(t, e, "Failed to dial")
+	cl, e := client.NewClient(conn)
+	failOnErr(t, e, "Failed to create client")
+	return conn, cl
+}
+
+func TestConnectionLimits(t *testing.T) {
+	cfg := &Config{MaxConnections: 3, MaxConnectionsPerIP: 2}
+	conn := func(addr string) net.Conn {
+		c, _ := net.Pipe()
+		return addrConn{Conn: c, addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}}
+	}
+	a1, a2, a3, b1, c1 := conn("10.0.0.1"), conn("10.0.0.1"), conn("10.0.0.1"), conn("10.0.0.2"), conn("10.0.0.3")
+	track := func(c net.Conn) error {
+		_, e := cfg.trackConn(c)
+		return e
+	}
+	for _, c := range []net.Conn{a1, a2, b1} {
+		failOnErr(t, track(c), "Connection rejected")
+	}
+	if e := track(a3); e != errTooManyConnections {
+		t.Fatalf("Connection over the total limit: %v", e)
+	}
+	cfg.untrackConn(b1)
+	if e := track(a3); e != errTooManyConnectionsPerIP {
+		t.Fatalf("Connection over the limit per address: %v", e)
+	}
+	failOnErr(t, track(c1), "Connection from another address rejected")
+	cfg.untrackConn(a1)
+	failOnErr(t, track(a3), "Connection after another one ended rejected")
+}
+
+func TestSlowClose(t *testing.T) {
+	var h handles
+	h.init()
+	f := &slowCloseFile{closing: make(chan struct{}), release: make(chan struct{})}
+	k := h.newFile(f)
+	h.newFile(EmptyFile{})
+	go h.closeHandle(k)
+	<-f.closing
+	// Other handles stay usable while a close is in progress.
+	counted := make(chan int)
+	go func() { counted <- h.count() }()
+	select {
+	case n := <-counted:
+		if n != 1 {
+			t.Fatalf("%d handles open during close, expected 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handles locked during a slow close")
+	}
+	close(f.release)
+}
+
+// slowCloseFile signals closing when Close is called and blocks
+// it until release is closed.
+type slowCloseFile struct {
+	EmptyFile
+	closing chan struct{}
+	release chan struct{}
+}
+
+func (f *slowCloseFile) Close() error {
+	close(f.closing)
+	<-f.release
+	return nil
+}
+
+func TestCloseIdleConns(t *testing.T) {
+	cfg := &Config{}
+	var conns [3]closedConn
+	var acts [3]*activity
+	for i := range conns {
+		c, _ := net.Pipe()
+		conns[i].Conn = c
+		acts[i], _ = cfg.trackConn(&conns[i])
+	}
+	// A request in flight and an open handle keep connections open.
+	acts[0].begin()
+	var h handles
+	h.init()
+	h.newFile(EmptyFile{})
+	acts[1].addSession(&h)
+	cfg.closeConns(false)
+	if conns[0].closed || conns[1].closed || !conns[2].closed {
+		t.Fatalf("Closed connections %v %v %v", conns[0].closed, conns[1].closed, conns[2].closed)
+	}
+	acts[0].end()
+	h.closeAll()
+	acts[1].removeSession(&h)
+	cfg.closeConns(false)
+	if !conns[0].closed || !conns[1].closed {
+		t.Fatal("Connections not closed after becoming idle")
+	}
+}
+
+func TestShutdownBlockedFile(t *testing.T) {
+	cfg := &Config{}
+	c, _ := net.Pipe()
+	act, e := cfg.trackConn(c)
+	failOnErr(t, e, "Connection rejected")
+	var h handles
+	h.init()
+	act.addSession(&h)
+	f := &blockingFile{closed: make(chan struct{})}
+	h.newFile(f)
+	act.begin()
+	go f.ReadAt(make([]byte, 1), 0)
+
+	// Shutdown returns at the deadline with the blocked file closed
+	// although the connection has not ended.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() { returned <- cfg.Shutdown(ctx) }()
+	select {
+	case e := <-returned:
+		if e != context.DeadlineExceeded {
+			t.Fatalf("Shutdown returned %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked by a file")
+	}
+	select {
+	case <-f.closed:
+	default:
+		t.Fatal("Blocked file was not closed")
+	}
+	if h.count() != 0 {
+		t.Fatalf("%d handles left open", h.count())
+	}
+}
+
+// blockingFile blocks reads until it is closed.
+type blockingFile struct {
+	EmptyFile
+	closed chan struct{}
+}
+
+func (f *blockingFile) ReadAt(bs []byte, offset int64) (int, error) {
+	<-f.closed
+	return 0, io.EOF
+}
+
+func (f *blockingFile) Close() error {
+	close(f.closed)
+	return nil
+}
+
+// closedConn records whether it has been closed.
+type closedConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closedConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestTimeouts(t *testing.T) {
+	// Requests in flight keep a connection open past the idle timeout,
+	// and it is closed once they have been idle for it.
+	act := newActivity()
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	act.begin()
+	go act.watchIdle(50*time.Millisecond, closerFunc(func() error { close(closed); return nil }), done)
+	select {
+	case <-closed:
+		t.Fatal("Connection with a request in flight was closed")
+	case <-time.After(150 * time.Millisecond):
+	}
+	act.end()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle connection was not closed")
+	}
+
+	// Requests served for a Config are tracked through the context.
+	rs := serveScriptActivity(act, testPacket(ssh_FXP_STAT, binp.Out().B32(1).B32String("/")))
+	if len(rs) != 1 || act.requests != 0 || act.idleFor() > time.Second {
+		t.Fatalf("Request not tracked: %d in flight, idle for %v", act.requests, act.idleFor())
+	}
+
+	cfg, listener := newTestConfig(t, EmptyFS{})
+	cfg.HandshakeTimeout = 50 * time.Millisecond
+	go cfg.Serve(listener)
+	defer cfg.Close()
+	conn, e := net.Dial("tcp", listener.Addr().String())
+	failOnErr(t, e, "Failed to connect")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, e = ioutil.ReadAll(conn); e != nil {
+		t.Fatalf("Connection without a handshake was not closed: %v", e)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// newTestConfig returns a Config for the test user and a listener
+// on a free port.
+func newTestConfig(t *testing.T, fs FileSystem) (*Config, net.Listener) {
+	cfg := &Config{FileSystem: fs}
+	cfg.Init()
+	cfg.PasswordCallback = sshutil.CreatePasswordCheck(testUser, testPass)
+	hkey, e := sshutil.KeyLoader{Flags: sshutil.Create}.Load()
+	failOnErr(t, e, "Failed to parse host key")
+	cfg.AddHostKey(hkey)
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, e, "Failed to listen")
+	return cfg, listener
+}
+
+func TestServe(t *testing.T) {
+	cfg, l1 := newTestConfig(t, EmptyFS{})
+	_, l2 := newTestConfig(t, EmptyFS{})
+	served := make(chan error, 2)
+	for _, l := range []net.Listener{l1, l2} {
+		go func(l net.Listener) { served <- cfg.Serve(l) }(l)
+	}
+	failOnErr(t, cfg.BlockTillReady(), "Not ready")
+	for _, l := range []net.Listener{l1, l2} {
+		conn, e := net.Dial("tcp", l.Addr().String())
+		failOnErr(t, e, "Failed to connect")
+		conn.Close()
+	}
+	cfg.Close()
+	for i := 0; i < 2; i++ {
+		if e := <-served; e != ErrServerClosed {
+			t.Fatalf("Serve returned %v", e)
+		}
+	}
+	_, l3 := newTestConfig(t, EmptyFS{})
+	if e := cfg.Serve(l3); e != ErrServerClosed {
+		t.Fatalf("Serve after Close returned %v", e)
+	}
+	if _, e := net.Dial("tcp", l3.Addr().String()); e == nil {
+		t.Fatal("Listener not closed by Serve after Close")
+	}
+
+	// A Config closed before serving must not block BlockTillReady.
+	closed, l4 := newTestConfig(t, EmptyFS{})
+	closed.Close()
+	if e := closed.Serve(l4); e != ErrServerClosed {
+		t.Fatalf("Serve on a closed Config returned %v", e)
+	}
+	if e := closed.BlockTillReady(); e != ErrServerClosed {
+		t.Fatalf("BlockTillReady on a closed Config returned %v", e)
+	}
+}
+
+func TestConfigFileSystemFunc(t *testing.T) {
+	released := make(chan string, 1)
+	cfg, listener := newTestConfig(t, nil)
+	cfg.FileSystemFunc = func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error) {
+		return &userFS{user: conn.User()}, nil
+	}
+	cfg.ReleaseFileSystem = func(conn ssh.ConnMetadata, fs FileSystem) {
+		released <- fs.(*userFS).user
+	}
+	go cfg.Serve(listener)
+	defer cfg.Close()
+
+	conn, cl := dialTestClient(t, listener.Addr().String())
+	fi, e := cl.Stat("/f")
+	failOnErr(t, e, "Failed to stat")
+	if fi.Size() != int64(len(testUser)) {
+		t.Fatalf("Invalid size %d from the file system of the user", fi.Size())
+	}
+	cl.Close()
+	conn.Close()
+	select {
+	case user := <-released:
+		if user != string(testUser) {
+			t.Fatalf("Released file system of user %q", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("File system was not released")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// Idle connections are closed right away and connections with
+	// open handles once they are closed.
+	idleCfg, idleListener := newTestConfig(t, shutdownFS{closed: make(chan struct{})})
+	go idleCfg.Serve(idleListener)
+	idleConn, _ := dialTestClient(t, idleListener.Addr().String())
+	defer idleConn.Close()
+	openConn, openCl := dialTestClient(t, idleListener.Addr().String())
+	defer openConn.Close()
+	f, e := openCl.Open("/f")
+	failOnErr(t, e, "Failed to open")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if e := idleCfg.Shutdown(ctx); e != nil {
+		t.Fatalf("Shutdown with idle connections returned %v", e)
+	}
+
+	closed := make(chan struct{})
+	cfg, listener := newTestConfig(t, shutdownFS{closed: closed})
+	served := make(chan error, 1)
+	go func() { served <- cfg.Serve(listener) }()
+
+	conn, cl := dialTestClient(t, listener.Addr().String())
+	defer conn.Close()
+	_, e = cl.Open("/f")
+	failOnErr(t, e, "Failed to open")
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if e := cfg.Shutdown(ctx); e != context.DeadlineExceeded {
+		t.Fatalf("Shutdown with an open connection returned %v", e)
+	}
+	select {
+	case <-closed:
+	default:
+		t.Fatal("Open file was not closed")
+	}
+	if e := <-served; e != ErrServerClosed {
+		t.Fatalf("Serve returned %v", e)
+	}
+	if _, e := net.Dial("tcp", listener.Addr().String()); e == nil {
+		t.Fatal("Connection accepted after Shutdown")
+	}
+}
+
+type shutdownFS struct {
+	EmptyFS
+	closed chan struct{}
+}
+
+func (fs shutdownFS) OpenFile(string, uint32, *Attr) (File, error) {
+	return shutdownFile{closed: fs.closed}, nil
+}
+
+type shutdownFile struct {
+	EmptyFile
+	closed chan struct{}
+}
+
+func (f shutdownFile) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestConfigContextFileSystemFunc(t *testing.T) {
+	released := make(chan string, 1)
+	cfg, listener := newTestConfig(t, nil)
+	cfg.FileSystemFunc = func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error) {
+		return nil, errors.New("FileSystemFunc used instead of ContextFileSystemFunc")
+	}
+	cfg.ContextFileSystemFunc = func(conn ssh.ConnMetadata, perms *ssh.Permissions) (ContextFileSystem, error) {
+		return &ctxUserFS{ContextFileSystem: ContextAdapter(EmptyFS{}), user: conn.User()}, nil
+	}
+	cfg.ReleaseContextFileSystem = func(conn ssh.ConnMetadata, fs ContextFileSystem) {
+		released <- fs.(*ctxUserFS).user
+	}
+	go cfg.Serve(listener)
+	defer cfg.Close()
+
+	conn, cl := dialTestClient(t, listener.Addr().String())
+	fi, e := cl.Stat("/f")
+	failOnErr(t, e, "Failed to stat")
+	if fi.Size() != int64(len(testUser)) {
+		t.Fatalf("Invalid size %d from the file system of the user", fi.Size())
+	}
+	cl.Close()
+	conn.Close()
+	select {
+	case user := <-released:
+		if user != string(testUser) {
+			t.Fatalf("Released file system of user %q", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("File system was not released")
+	}
+}
+
+// ctxUserFS reports the length of the user name of the connection
+// as the size of all files.
+type ctxUserFS struct {
+	ContextFileSystem
+	user string
+}
+
+func (fs *ctxUserFS) Stat(ctx context.Context, name string, islstat bool) (*Attr, error) {
+	if _, ok := ConnMetadataFromContext(ctx); !ok {
+		return nil, Failure
+	}
+	return &Attr{Flags: ATTR_SIZE, Size: uint64(len(fs.user))}, nil
+}
+
+// userFS reports the length of the user name as the size of all files.
+type userFS struct {
+	EmptyFS
+	user string
+}
+
+func (fs *userFS) Stat(string, bool) (*Attr, error) {
+	return &Attr{Flags: ATTR_SIZE, Size: uint64(len(fs.user))}, nil
+}
+
+func TestRename(t *testing.T) {
+	os.Mkdir("/tmp/test-sftpd", 0700)
+	os.Remove("/tmp/test-sftpd/rename-dst")
+	failOnErr(t, ioutil.WriteFile("/tmp/test-sftpd/rename-src", []byte("data"), 0600), "Failed to create file")
+	failOnErr(t, ioutil.WriteFile("/tmp/test-sftpd/rename-other", []byte("other"), 0600), "Failed to create file")
+	runClientTest(t, rfs{}, func(cl *client.Client) error {
+		e := cl.Rename("/rename-src", "/rename-dst")
+		if e != nil {
+			return e
+		}
+		if cl.Rename("/rename-other", "/rename-dst") == nil {
+			return errors.New("Rename over an existing file succeeded")
+		}
+		return nil
+	})
+	_, e := os.Stat("/tmp/test-sftpd/rename-src")
+	if !os.IsNotExist(e) {
+		t.Fatalf("Rename source still exists: %v", e)
+	}
+	bs, e := ioutil.ReadFile("/tmp/test-sftpd/rename-dst")
+	failOnErr(t, e, "Failed to read rename destination")
+	if string(bs) != "data" {
+		t.Fatalf("Rename destination has wrong contents %q", bs)
+	}
+}
+
+func TestPosixRename(t *testing.T) {
+	os.Mkdir("/tmp/test-sftpd", 0700)
+	failOnErr(t, ioutil.WriteFile("/tmp/test-sftpd/posix-rename-src", []byte("new"), 0600), "Failed to create file")
+	failOnErr(t, ioutil.WriteFile("/tmp/test-sftpd/posix-rename-dst", []byte("old"), 0600), "Failed to create file")
+	runClientTest(t, rfs{}, func(cl *client.Client) error {
+		return cl.PosixRename("/posix-rename-src", "/posix-rename-dst")
+	})
+	bs, e := ioutil.ReadFile("/tmp/test-sftpd/posix-rename-dst")
+	failOnErr(t, e, "Failed to read rename destination")
+	if string(bs) != "new" {
+		t.Fatalf("Rename destination has wrong contents %q", bs)
+	}
+}
+
+func TestPosixRenameFlags(t *testing.T) {
+	var fs renameFS
+	rs := serveScript(&fs,
+		testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+		testPacket(ssh_FXP_RENAME, binp.Out().B32(1).B32String("/a").B32String("/b")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("posix-rename@openssh.com").B32String("/c").B32String("/d")))
+	if len(rs) != 3 {
+		t.Fatalf("Got %d replies, expected 3", len(rs))
+	}
+	if !bytes.Contains(rs[0], []byte("posix-rename@openssh.com")) {
+		t.Fatalf("posix-rename@openssh.com not advertised: %X", rs[0])
+	}
+	exp := []string{"/a /b 0", "/c /d 3"}
+	if strings.Join(fs.calls, ",") != strings.Join(exp, ",") {
+		t.Fatalf("Invalid rename calls %q", fs.calls)
+	}
+}
+
+func TestHardlink(t *testing.T) {
+	os.Mkdir("/tmp/test-sftpd", 0700)
+	os.Remove("/tmp/test-sftpd/hardlink")
+	failOnErr(t, ioutil.WriteFile("/tmp/test-sftpd/hardlink-src", []byte("data"), 0600), "Failed to create file")
+	runClientTest(t, rfs{}, func(cl *client.Client) error {
+		return cl.Link("/hardlink-src", "/hardlink")
+	})
+	fi1, e := os.Stat("/tmp/test-sftpd/hardlink-src")
+	failOnErr(t, e, "Failed to stat link source")
+	fi2, e := os.Lstat("/tmp/test-sftpd/hardlink")
+	failOnErr(t, e, "Failed to stat link")
+	if !os.SameFile(fi1, fi2) {
+		t.Fatal("Hard link does not point to the source")
+	}
+}
+
+func TestHardlinkUnsupported(t *testing.T) {
+	rs := serveScript(EmptyFS{},
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("hardlink@openssh.com").B32String("/a").B32String("/b")))
+	if len(rs) != 1 || binary.BigEndian.Uint32(rs[0][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid hardlink reply: %X", rs)
+	}
+	rs = serveScript(EmptyFS{},
+		testPacket(ssh_FXP_SYMLINK, binp.Out().B32(1).B32String("/a").B32String("/b")))
+	if len(rs) != 1 || binary.BigEndian.Uint32(rs[0][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid symlink reply: %X", rs)
+	}
+}
+
+func TestFsync(t *testing.T) {
+	var fs syncFS
+	rs := serveScript(&fs,
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/sync").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("fsync@openssh.com").B32String("f1")),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(3).B32String("/nosync").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(4).B32String("fsync@openssh.com").B32String("f2")))
+	if len(rs) != 4 {
+		t.Fatalf("Got %d replies, expected 4", len(rs))
+	}
+	if fs.synced != 1 || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_OK {
+		t.Fatalf("Invalid fsync reply: %X", rs[1])
+	}
+	if binary.BigEndian.Uint32(rs[3][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid fsync reply for a file without Sync: %X", rs[3])
+	}
+}
+
+type syncFS struct {
+	EmptyFS
+	synced int
+}
+
+type syncFile struct {
+	EmptyFile
+	fs *syncFS
+}
+
+func (f syncFile) Sync() error {
+	f.fs.synced++
+	return nil
+}
+
+func (fs *syncFS) OpenFile(path string, flags uint32, a *Attr) (File, error) {
+	if path == "/sync" {
+		return syncFile{fs: fs}, nil
+	}
+	return EmptyFile{}, nil
+}
+
+func TestCopyData(t *testing.T) {
+	src := bytes.Repeat([]byte("0123456789"), 20000)
+	fs := memFS{files: map[string]*memFile{"/src": {bs: src}, "/dst": {}}}
+	rs := serveScript(fs,
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/src").B32(0).B32(0)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/dst").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("copy-data").
+			B32String("f1").B64(5).B64(0).B32String("f2").B64(1)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(4).B32String("copy-data").
+			B32String("f1").B64(0).B64(10).B32String("f1").B64(5)))
+	if len(rs) != 4 {
+		t.Fatalf("Got %d replies, expected 4", len(rs))
+	}
+	if binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_OK {
+		t.Fatalf("Invalid copy-data reply: %X", rs[2])
+	}
+	if !bytes.Equal(fs.files["/dst"].bs[1:], src[5:]) {
+		t.Fatal("copy-data produced wrong contents")
+	}
+	if binary.BigEndian.Uint32(rs[3][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("Overlapping copy-data did not fail: %X", rs[3])
+	}
+
+	// Read errors of the source are reported.
+	rs = serveScript(&syncFS{},
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/src").B32(0).B32(0)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/dst").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("copy-data").
+			B32String("f1").B64(0).B64(0).B32String("f2").B64(0)))
+	if len(rs) != 3 || binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("copy-data from a failing file did not fail: %X", rs)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 60)
+	fs := memFS{files: map[string]*memFile{"/f": {bs: data}}}
+	rs := serveScript(fs,
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("check-file-handle").
+			B32String("f1").B32String("foo,md5,sha1").B64(0).B64(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("check-file-name").
+			B32String("/f").B32String("sha256").B64(10).B64(0).B32(256)))
+	if len(rs) != 3 {
+		t.Fatalf("Got %d replies, expected 3", len(rs))
+	}
+	sum := md5.Sum(data)
+	exp := append(binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(2).B32String("check-file").B32String("md5").Out(), sum[:]...)
+	if !bytes.Equal(rs[1], exp) {
+		t.Fatalf("Invalid check-file-handle reply: %X", rs[1])
+	}
+	exp = binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(3).B32String("check-file").B32String("sha256").Out()
+	for _, block := range [][]byte{data[10:266], data[266:522], data[522:]} {
+		sum := sha256.Sum256(block)
+		exp = append(exp, sum[:]...)
+	}
+	if !bytes.Equal(rs[2], exp) {
+		t.Fatalf("Invalid check-file-name reply: %X", rs[2])
+	}
+
+	// Read errors are reported instead of the hash of partial data.
+	rs = serveScript(&syncFS{},
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("check-file-handle").
+			B32String("f1").B32String("md5").B64(0).B64(0).B32(0)))
+	if len(rs) != 2 || rs[1][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("check-file-handle of a failing file did not fail: %X", rs)
+	}
+
+	// check-file-name opens files like SSH_FXP_OPEN.
+	rs = serveScript(openerFS{files: fs},
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("check-file-name").
+			B32String("/f").B32String("md5").B64(0).B64(0).B32(0)))
+	exp = append(binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(1).B32String("check-file").B32String("md5").Out(), sum[:]...)
+	if len(rs) != 1 || !bytes.Equal(rs[0], exp) {
+		t.Fatalf("Invalid check-file-name reply with an Opener: %X", rs)
+	}
+}
+
+// openerFS opens read-only files only with Opener.
+type openerFS struct {
+	EmptyFS
+	files memFS
+}
+
+func (fs openerFS) Open(r *OpenRequest) (File, error) {
+	if !r.Read || r.Write || r.Disposition != DISPOSITION_OPEN_EXISTING {
+		return nil, Failure
+	}
+	return fs.files.OpenFile(r.Path, r.flags3(), &r.Attr)
+}
+
+func TestLargeWrite(t *testing.T) {
+	data := make([]byte, 255*1024)
+	_, e := rand.Read(data)
+	failOnErr(t, e, "Failed to generate data")
+	for _, workers := range []int{1, 4} {
+		fs := memFS{files: map[string]*memFile{"/f": {}}}
+		write := func(id uint32, offset uint64, bs []byte) []byte {
+			return testPacket(ssh_FXP_WRITE, binp.Out().B32(id).B32String("f1").B64(offset).B32String(string(bs)))
+		}
+		rs := serveScriptOptions(&ServerOptions{Workers: workers}, fs,
+			testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(ssh_FXF_WRITE).B32(0)),
+			write(2, 0, data[:1000]),
+			write(3, 1000, data[1000:]),
+			write(4, 0, data[:10]))
+		if len(rs) != 4 {
+			t.Fatalf("Got %d replies, expected 4", len(rs))
+		}
+		for _, r := range rs[1:] {
+			if r[0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(r[5:]) != ssh_FX_OK {
+				t.Fatalf("Write failed: %X", r)
+			}
+		}
+		if !bytes.Equal(fs.files["/f"].bs, data) {
+			t.Fatalf("Invalid data written with %d workers", workers)
+		}
+	}
+
+	// Packets larger than the limit end the session.
+	fs := memFS{files: map[string]*memFile{"/f": {}}}
+	rs := serveScriptOptions(&ServerOptions{MaxPacketLength: 128 * 1024}, fs,
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(ssh_FXF_WRITE).B32(0)),
+		testPacket(ssh_FXP_WRITE, binp.Out().B32(2).B32String("f1").B64(0).B32String(string(data))),
+		testPacket(ssh_FXP_STAT, binp.Out().B32(3).B32String("/f")))
+	if len(rs) != 1 || len(fs.files["/f"].bs) != 0 {
+		t.Fatalf("Too long packet was accepted: %X", rs)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limits := testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("limits@openssh.com"))
+	rs := serveScript(EmptyFS{}, limits)
+	exp := binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(1).B64(256 * 1024).B64(64 * 1024).B64(255 * 1024).B64(256).Out()
+	if len(rs) != 1 || !bytes.Equal(rs[0], exp) {
+		t.Fatalf("Invalid default limits: %X", rs)
+	}
+	o := &ServerOptions{MaxPacketLength: 128 * 1024, MaxReadLength: 1024, MaxOpenHandles: 1}
+	fs := memFS{files: map[string]*memFile{"/f": {bs: make([]byte, 4096)}}}
+	rs = serveScriptOptions(o, fs, limits,
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/f").B32(0).B32(0)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(3).B32String("/f").B32(0).B32(0)),
+		testPacket(ssh_FXP_READ, binp.Out().B32(4).B32String("f1").B64(0).B32(4096)))
+	exp = binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(1).B64(128 * 1024).B64(1024).B64(127 * 1024).B64(1).Out()
+	if len(rs) != 4 || !bytes.Equal(rs[0], exp) {
+		t.Fatalf("Invalid limits: %X", rs)
+	}
+	if rs[2][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("Handle limit not enforced: %X", rs[2])
+	}
+	if rs[3][0] != ssh_FXP_DATA || len(rs[3]) != 1+4+4+1024 {
+		t.Fatalf("Read limit not enforced: %X", rs[3])
+	}
+}
+
+func TestStatVFS(t *testing.T) {
+	rs := serveScript(EmptyFS{}, testPacket(ssh_FXP_INIT, binp.Out().B32(3)))
+	if len(rs) != 1 || bytes.Contains(rs[0], []byte("statvfs")) {
+		t.Fatalf("statvfs advertised without support: %X", rs)
+	}
+	rs = serveScript(statFS{},
+		testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("statvfs@openssh.com").B32String("/")))
+	if len(rs) != 2 {
+		t.Fatalf("Got %d replies, expected 2", len(rs))
+	}
+	if !bytes.Contains(rs[0], []byte("\x00\x00\x00\x14fstatvfs@openssh.com\x00\x00\x00\x012")) {
+		t.Fatalf("fstatvfs@openssh.com not advertised: %X", rs[0])
+	}
+	if len(rs[1]) != 1+4+11*8 || rs[1][0] != ssh_FXP_EXTENDED_REPLY || binary.BigEndian.Uint64(rs[1][5+16:]) != 1000 {
+		t.Fatalf("Invalid statvfs reply: %X", rs[1])
+	}
+	rs = serveScript(statFS{},
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/statvfs").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("fstatvfs@openssh.com").B32String("f1")),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(3).B32String("/plain").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(4).B32String("fstatvfs@openssh.com").B32String("f2")))
+	if len(rs) != 4 {
+		t.Fatalf("Got %d replies, expected 4", len(rs))
+	}
+	if len(rs[1]) != 1+4+11*8 || rs[1][0] != ssh_FXP_EXTENDED_REPLY || binary.BigEndian.Uint64(rs[1][5+16:]) != 2000 {
+		t.Fatalf("Invalid fstatvfs reply: %X", rs[1])
+	}
+	if binary.BigEndian.Uint32(rs[3][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid fstatvfs reply for a file without FStatVFS: %X", rs[3])
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	rs := serveScript(homeFS{},
+		testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("expand-path@openssh.com").B32String("~/x/../y")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("expand-path@openssh.com").B32String("~bob")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("expand-path@openssh.com").B32String("/z/.")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(4).B32String("home-directory").B32String("")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(5).B32String("home-directory").B32String("nobody")))
+	if len(rs) != 6 {
+		t.Fatalf("Got %d replies, expected 6", len(rs))
+	}
+	if !bytes.Contains(rs[0], []byte("home-directory")) {
+		t.Fatalf("home-directory not advertised: %X", rs[0])
+	}
+	for i, exp := range []string{"/home/test/y", "/home/bob", "/z", "/home/test"} {
+		r := rs[i+1]
+		if r[0] != ssh_FXP_NAME || !bytes.Equal(r[5:], (&session{version: 3}).nameOnly(exp)) {
+			t.Fatalf("Invalid reply for %q: %X", exp, r)
+		}
+	}
+	if rs[5][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[5][5:]) != ssh_FX_NO_SUCH_FILE {
+		t.Fatalf("Invalid reply for an unknown user: %X", rs[5])
+	}
+}
+
+func TestLSetStat(t *testing.T) {
+	rs := serveScript(EmptyFS{},
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("lsetstat@openssh.com").B32String("/l").B32(0)))
+	if len(rs) != 1 || binary.BigEndian.Uint32(rs[0][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid lsetstat reply without support: %X", rs)
+	}
+	var fs lsetstatFS
+	rs = serveScript(&fs,
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("lsetstat@openssh.com").B32String("/l").
+			B32(ssh_FILEXFER_ATTR_ACMODTIME).B32(1).B32(2)))
+	if len(rs) != 1 || binary.BigEndian.Uint32(rs[0][5:]) != ssh_FX_OK {
+		t.Fatalf("Invalid lsetstat reply: %X", rs)
+	}
+	if fs.path != "/l" || fs.attr.MTime.Unix() != 2 {
+		t.Fatalf("Invalid lsetstat call %q %v", fs.path, fs.attr)
+	}
+}
+
+type lsetstatFS struct {
+	EmptyFS
+	path string
+	attr Attr
+}
+
+func (fs *lsetstatFS) LSetStat(path string, a *Attr) error {
+	fs.path, fs.attr = path, *a
+	return nil
+}
+
+func TestUsersGroupsByID(t *testing.T) {
+	dir, e := ioutil.TempDir("", "sftpd")
+	failOnErr(t, e, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/passwd", []byte("root:x:0:0::/root:/bin/sh\nbob:x:1000:1000::/home/bob:/bin/sh\n"), 0600), "Failed to write passwd")
+	failOnErr(t, ioutil.WriteFile(dir+"/group", []byte("wheel:x:10:bob\n"), 0600), "Failed to write group")
+	r := &PasswdResolver{PasswdFile: dir + "/passwd", GroupFile: dir + "/group"}
+
+	rs := serveScriptOptions(&ServerOptions{NameResolver: r}, EmptyFS{},
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("users-groups-by-id@openssh.com").
+			B32String(string(binp.Out().B32(1000).B32(5).B32(0).Out())).B32String(string(binp.Out().B32(10).Out()))))
+	users := binp.Out().B32String("bob").B32String("").B32String("root").Out()
+	groups := binp.Out().B32String("wheel").Out()
+	exp := binp.Out().Byte(ssh_FXP_EXTENDED_REPLY).B32(1).B32String(string(users)).B32String(string(groups)).Out()
+	if len(rs) != 1 || !bytes.Equal(rs[0], exp) {
+		t.Fatalf("Invalid users-groups-by-id reply: %X", rs)
+	}
+
+	fi := NamedAttr{Name: "f", Attr: Attr{Flags: ATTR_UIDGID, Uid: 1000, Gid: 20}}
+	if ln := readdirLongName(&fi, r); !strings.Contains(ln, " bob      20 ") {
+		t.Fatalf("Invalid long name %q", ln)
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	for _, c := range []struct{ client, max, exp uint32 }{{3, 0, 3}, {4, 0, 4}, {6, 0, 6}, {7, 0, 6}, {6, 4, 4}, {2, 0, 3}} {
+		rs := serveScriptOptions(&ServerOptions{MaxVersion: c.max}, EmptyFS{}, testPacket(ssh_FXP_INIT, binp.Out().B32(c.client)))
+		if len(rs) != 1 || rs[0][0] != ssh_FXP_VERSION || binary.BigEndian.Uint32(rs[0][1:]) != c.exp {
+			t.Fatalf("Client version %d with max %d: invalid reply %X", c.client, c.max, rs)
+		}
+	}
+}
+
+func TestVersion4Attr(t *testing.T) {
+	r := &PasswdResolver{}
+	var fs attrFS
+	rs := serveScriptOptions(&ServerOptions{NameResolver: r}, &fs,
+		testPacket(ssh_FXP_INIT, binp.Out().B32(4)),
+		testPacket(ssh_FXP_STAT, binp.Out().B32(1).B32String("/f").B32(0xFFFFFFFF)),
+		testPacket(ssh_FXP_OPENDIR, binp.Out().B32(2).B32String("/")),
+		testPacket(ssh_FXP_READDIR, binp.Out().B32(3).B32String("d1")),
+		testPacket(ssh_FXP_SETSTAT, binp.Out().B32(4).B32String("/f").
+			B32(ssh_FILEXFER_ATTR_MODIFYTIME|ssh_FILEXFER_ATTR_OWNERGROUP|ssh_FILEXFER_ATTR_ACL).Byte(ssh_FILEXFER_TYPE_REGULAR).
+			B32String("bob").B32String("users").B64(1000).B32String("")),
+		testPacket(ssh_FXP_REALPATH, binp.Out().B32(5).B32String("/x/..")))
+	if len(rs) != 6 {
+		t.Fatalf("Got %d replies, expected 6", len(rs))
+	}
+	attr := binp.Out().B32(ssh_FILEXFER_ATTR_SIZE | ssh_FILEXFER_ATTR_OWNERGROUP | ssh_FILEXFER_ATTR_PERMISSIONS |
+		ssh_FILEXFER_ATTR_MODIFYTIME | ssh_FILEXFER_ATTR_SUBSECOND_TIMES).Byte(ssh_FILEXFER_TYPE_REGULAR).
+		B64(5).B32String("0").B32String("wheel").B32(0100644).B64(1234).B32(5678).Out()
+	if !bytes.Equal(rs[1], append(binp.Out().Byte(ssh_FXP_ATTRS).B32(1).Out(), attr...)) {
+		t.Fatalf("Invalid version 4 attributes: %X", rs[1])
+	}
+	name := append(binp.Out().Byte(ssh_FXP_NAME).B32(3).B32(1).B32String("f").Out(), attr...)
+	if !bytes.Equal(rs[3], name) {
+		t.Fatalf("Invalid version 4 readdir reply: %X", rs[3])
+	}
+	if binary.BigEndian.Uint32(rs[4][5:]) != ssh_FX_OK || fs.set.Flags != ATTR_TIME|ATTR_OWNERGROUP ||
+		!fs.set.ATime.IsZero() || fs.set.MTime.Unix() != 1000 || fs.set.User != "bob" || fs.set.Group != "users" {
+		t.Fatalf("Invalid version 4 setstat: %X %v", rs[4], fs.set)
+	}
+	name = binp.Out().Byte(ssh_FXP_NAME).B32(5).B32(1).B32String("/").B32(0).Byte(ssh_FILEXFER_TYPE_UNKNOWN).Out()
+	if !bytes.Equal(rs[5], name) {
+		t.Fatalf("Invalid version 4 realpath reply: %X", rs[5])
+	}
+}
+
+func TestSymlinkOrder(t *testing.T) {
+	for _, c := range []struct {
+		version       uint32
+		first, second string
+	}{{3, "/t", "/l"}, {4, "/l", "/t"}, {5, "/l", "/t"}} {
+		var fs v6FS
+		rs := serveScript(&fs,
+			testPacket(ssh_FXP_INIT, binp.Out().B32(c.version)),
+			testPacket(ssh_FXP_SYMLINK, binp.Out().B32(1).B32String(c.first).B32String(c.second)))
+		if len(rs) != 2 || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_OK || strings.Join(fs.calls, ",") != "link /l /t 0" {
+			t.Fatalf("Invalid version %d symlink: %X %v", c.version, rs, fs.calls)
+		}
+	}
+}
+
+func TestVersion6(t *testing.T) {
+	var fs v6FS
+	rs := serveScriptOptions(&ServerOptions{NameResolver: &PasswdResolver{}}, &fs,
+		testPacket(ssh_FXP_INIT, binp.Out().B32(6)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(ace4_READ_DATA|ace4_APPEND_DATA).
+			B32(ssh_FXF_OPEN_OR_CREATE|ssh_FXF_APPEND_DATA|ssh_FXF_NOFOLLOW).B32(0).Byte(ssh_FILEXFER_TYPE_REGULAR)),
+		testPacket(ssh_FXP_SETSTAT, binp.Out().B32(2).B32String("/f").B32(ssh_FILEXFER_ATTR_BITS).Byte(ssh_FILEXFER_TYPE_REGULAR).
+			B32(ATTRIB_HIDDEN|ATTRIB_READONLY).B32(ATTRIB_HIDDEN|ATTRIB_IMMUTABLE)),
+		testPacket(ssh_FXP_STAT, binp.Out().B32(3).B32String("/f").B32(0xFFFFFFFF)),
+		testPacket(ssh_FXP_LINK, binp.Out().B32(4).B32String("/l").B32String("/f").Byte(1)),
+		testPacket(ssh_FXP_RENAME, binp.Out().B32(5).B32String("/f").B32String("/g").B32(RENAME_OVERWRITE)),
+		testPacket(ssh_FXP_REALPATH, binp.Out().B32(6).B32String("/a").Byte(ssh_FXP_REALPATH_STAT_ALWAYS).B32String("b")),
+		testPacket(ssh_FXP_BLOCK, binp.Out().B32(7).B32String("nonexistent").B64(0).B64(0).B32(BLOCK_READ)))
+	if len(rs) != 8 {
+		t.Fatalf("Got %d replies, expected 8", len(rs))
+	}
+	r := fs.open
+	if r.Path != "/f" || !r.Read || !r.Write || !r.Append || !r.NoFollow || r.Disposition != DISPOSITION_OPEN_OR_CREATE {
+		t.Fatalf("Invalid decoded open request %+v", r)
+	}
+	if binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_FILE_ALREADY_EXISTS {
+		t.Fatalf("Invalid open reply %X", rs[1])
+	}
+	if fs.set.Flags != ATTR_BITS || fs.set.AttribBits != ATTRIB_HIDDEN || fs.set.AttribBitsValid != ATTRIB_HIDDEN|ATTRIB_IMMUTABLE {
+		t.Fatalf("Invalid version 6 setstat: %X %v", rs[2], fs.set)
+	}
+	attr := binp.Out().B32(ssh_FILEXFER_ATTR_SIZE | ssh_FILEXFER_ATTR_OWNERGROUP | ssh_FILEXFER_ATTR_PERMISSIONS |
+		ssh_FILEXFER_ATTR_MODIFYTIME | ssh_FILEXFER_ATTR_SUBSECOND_TIMES | ssh_FILEXFER_ATTR_BITS).Byte(ssh_FILEXFER_TYPE_REGULAR).
+		B64(5).B32String("0").B32String("wheel").B32(0100644).B64(1234).B32(5678).B32(ATTRIB_HIDDEN).B32(ATTRIB_HIDDEN | ATTRIB_IMMUTABLE).Out()
+	if !bytes.Equal(rs[3], append(binp.Out().Byte(ssh_FXP_ATTRS).B32(3).Out(), attr...)) {
+		t.Fatalf("Invalid version 6 attributes: %X", rs[3])
+	}
+	if binary.BigEndian.Uint32(rs[4][5:]) != ssh_FX_OK || binary.BigEndian.Uint32(rs[5][5:]) != ssh_FX_OK ||
+		strings.Join(fs.calls, ",") != "link /l /f 0,rename /f /g 1" {
+		t.Fatalf("Invalid link/rename: %X %X %v", rs[4], rs[5], fs.calls)
+	}
+	name := append(binp.Out().Byte(ssh_FXP_NAME).B32(6).B32(1).B32String("/a/b").Out(), attr...)
+	if !bytes.Equal(rs[6], name) {
+		t.Fatalf("Invalid version 6 realpath reply: %X", rs[6])
+	}
+	if rs[7][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[7][5:]) != ssh_FX_INVALID_HANDLE {
+		t.Fatalf("Invalid reply to a block on an invalid handle: %X", rs[7])
+	}
+
+	// Options without an OPEN_* equivalent are not supported by OpenFile.
+	rs = serveScript(&fs.attrFS,
+		testPacket(ssh_FXP_INIT, binp.Out().B32(6)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(ace4_READ_DATA).
+			B32(ssh_FXF_OPEN_EXISTING|ssh_FXF_NOFOLLOW).B32(0).Byte(ssh_FILEXFER_TYPE_REGULAR)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/f").B32(ace4_READ_DATA).
+			B32(ssh_FXF_OPEN_EXISTING|ssh_FXF_DELETE_ON_CLOSE).B32(0).Byte(ssh_FILEXFER_TYPE_REGULAR)))
+	if len(rs) != 3 || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_OP_UNSUPPORTED || binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Invalid replies to unsupported open options: %X", rs)
+	}
+
+	// Status codes newer than the negotiated version are sent as failures.
+	rs = serveScript(&fs,
+		testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(ssh_FXF_READ|ssh_FXF_CREAT|ssh_FXF_EXCL).B32(0)))
+	if len(rs) != 2 || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("Invalid version 3 open reply %X", rs)
+	}
+	if r := fs.open; !r.Read || r.Write || r.Disposition != DISPOSITION_CREATE_NEW || r.flags3() != ssh_FXF_READ|ssh_FXF_CREAT|ssh_FXF_EXCL {
+		t.Fatalf("Invalid decoded version 3 open request %+v", r)
+	}
+}
+
+func TestInvalidHandle(t *testing.T) {
+	rs := serveScript(EmptyFS{},
+		testPacket(ssh_FXP_READ, binp.Out().B32(1).B32String("f9").B64(0).B32(10)),
+		testPacket(ssh_FXP_WRITE, binp.Out().B32(2).B32String("f9").B64(0).B32String("x")),
+		testPacket(ssh_FXP_READDIR, binp.Out().B32(3).B32String("d9")))
+	if len(rs) != 3 {
+		t.Fatalf("Session ended by an invalid handle: %X", rs)
+	}
+	for i, r := range rs {
+		if r[0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(r[1:]) != uint32(i+1) || binary.BigEndian.Uint32(r[5:]) != ssh_FX_FAILURE {
+			t.Fatalf("Invalid reply to an invalid handle: %X", r)
+		}
+	}
+}
+
+type v6FS struct {
+	attrFS
+	open  OpenRequest
+	calls []string
+}
+
+func (fs *v6FS) Open(r *OpenRequest) (File, error) {
+	fs.open = *r
+	return nil, os.ErrExist
+}
+func (fs *v6FS) Stat(string, bool) (*Attr, error) {
+	a := testAttr
+	a.Flags |= ATTR_BITS
+	a.AttribBits, a.AttribBitsValid = fs.set.AttribBits, fs.set.AttribBitsValid
+	return &a, nil
+}
+func (fs *v6FS) CreateLink(path, target string, flags uint32) error {
+	fs.calls = append(fs.calls, fmt.Sprintf("link %s %s %d", path, target, flags))
+	return nil
+}
+func (fs *v6FS) Rename(oldpath, newpath string, flags uint32) error {
+	fs.calls = append(fs.calls, fmt.Sprintf("rename %s %s %d", oldpath, newpath, flags))
+	return nil
+}
+
+type attrFS struct {
+	EmptyFS
+	set Attr
+}
+
+var testAttr = Attr{Flags: ATTR_SIZE | ATTR_UIDGID | ATTR_MODE | ATTR_TIME, Size: 5, Gid: 10, Group: "wheel",
+	Mode: 0644, MTime: time.Unix(1234, 5678)}
+
+func (*attrFS) Stat(string, bool) (*Attr, error) {
+	a := testAttr
+	return &a, nil
+}
+func (*attrFS) OpenDir(string) (Dir, error) {
+	return &attrDir{}, nil
+}
+func (fs *attrFS) SetStat(path string, a *Attr) error {
+	fs.set = *a
+	return nil
+}
+
+type attrDir struct{ done bool }
+
+func (d *attrDir) Readdir(count int) ([]NamedAttr, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	d.done = true
+	return []NamedAttr{{Name: "f", Attr: testAttr}}, nil
+}
+func (*attrDir) Close() error { return nil }
+
+type homeFS struct{ EmptyFS }
+
+func (homeFS) HomeDir(user string) (string, error) {
+	switch user {
+	case "":
+		return "/home/test", nil
+	case "bob":
+		return "/home/bob/", nil
+	}
+	return "", os.ErrNotExist
+}
+
+type statFS struct{ EmptyFS }
+
+func (statFS) StatVFS(path string) (*StatVFS, error) {
+	return &StatVFS{BlockSize: 4096, FragmentSize: 4096, Blocks: 1000, MaxNameLength: 255}, nil
+}
+
+func (statFS) OpenFile(path string, flags uint32, a *Attr) (File, error) {
+	if path == "/statvfs" {
+		return statFile{}, nil
+	}
+	return EmptyFile{}, nil
+}
+
+type statFile struct{ EmptyFile }
+
+func (statFile) FStatVFS() (*StatVFS, error) {
+	return &StatVFS{BlockSize: 512, Blocks: 2000}, nil
+}
+
+type renameFS struct {
+	EmptyFS
+	calls []string
+}
+
+func (fs *renameFS) Rename(oldpath, newpath string, flags uint32) error {
+	fs.calls = append(fs.calls, fmt.Sprintf("%s %s %d", oldpath, newpath, flags))
+	return nil
+}
+
+func TestWorkers(t *testing.T) {
+	w := &workers{queues: make([]chan request, 4)}
+	stat := func(id uint32, path string) []byte {
+		return testPacket(ssh_FXP_STAT, binp.Out().B32(id).B32String(path))
+	}
+	if w.queue(ssh_FXP_STAT, stat(1, "/slow")[5:]) == w.queue(ssh_FXP_STAT, stat(2, "/fast")[5:]) {
+		t.Fatal("Test paths are served by the same worker")
+	}
+	fs := &workerFS{release: make(chan struct{})}
+	// The file is opened with the path of its handle to be served by the
+	// same worker as the writes.
+	packets := [][]byte{stat(1, "/slow"), stat(2, "/fast"),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(3).B32String("f1").B32(ssh_FXF_WRITE).B32(0))}
+	for i := 0; i < 32; i++ {
+		packets = append(packets, testPacket(ssh_FXP_WRITE, binp.Out().B32(uint32(4+i)).B32String("f1").B64(uint64(i)).B32String("x")))
+	}
+	rs := serveScriptOptions(&ServerOptions{Workers: 4}, fs, packets...)
+	if len(rs) != len(packets) {
+		t.Fatalf("Got %d replies, expected %d", len(rs), len(packets))
+	}
+	if id := binary.BigEndian.Uint32(rs[0][1:]); id != 2 {
+		t.Fatalf("Blocked request was not served concurrently, first reply for %d", id)
+	}
+	for i, off := range fs.offsets {
+		if off != int64(i) {
+			t.Fatalf("Writes to a handle were reordered: %v", fs.offsets)
+		}
+	}
+}
+
+func TestLateInit(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		rs := serveScriptOptions(&ServerOptions{Workers: workers}, EmptyFS{},
+			testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+			testPacket(ssh_FXP_STAT, binp.Out().B32(1).B32String("/f")),
+			testPacket(ssh_FXP_INIT, binp.Out().B32(6)),
+			testPacket(ssh_FXP_STAT, binp.Out().B32(2).B32String("/f")))
+		if len(rs) != 2 || rs[0][0] != ssh_FXP_VERSION || binary.BigEndian.Uint32(rs[1][1:]) != 1 {
+			t.Fatalf("Session not ended by a repeated INIT with %d workers: %X", workers, rs)
+		}
+	}
+}
+
+type workerFS struct {
+	EmptyFS
+	release chan struct{}
+	offsets []int64
+}
+
+func (fs *workerFS) Stat(path string, islstat bool) (*Attr, error) {
+	if path == "/fast" {
+		close(fs.release)
+		return &Attr{}, nil
+	}
+	select {
+	case <-fs.release:
+		return &Attr{}, nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("not released")
+	}
+}
+func (fs *workerFS) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	return &workerFile{fs: fs}, nil
+}
+
+type workerFile struct {
+	EmptyFile
+	fs *workerFS
+}
+
+func (f *workerFile) WriteAt(bs []byte, offset int64) (int, error) {
+	f.fs.offsets = append(f.fs.offsets, offset)
+	return len(bs), nil
+}
+
+func TestSequentialFile(t *testing.T) {
+	var fs sequentialFS
+	read := func(id uint32, handle string, offset uint64, length uint32) []byte {
+		return testPacket(ssh_FXP_READ, binp.Out().B32(id).B32String(handle).B64(offset).B32(length))
+	}
+	open := func(id uint32, path string, flags uint32) []byte {
+		return testPacket(ssh_FXP_OPEN, binp.Out().B32(id).B32String(path).B32(flags).B32(0))
+	}
+	rs := serveScript(&fs,
+		open(1, "/r", ssh_FXF_READ),
+		read(2, "f1", 0, 5),
+		read(3, "f1", 5, 100),
+		read(4, "f1", 200, 100),
+		open(5, "/r", ssh_FXF_READ),
+		read(6, "f2", 3, 5),
+		open(7, "/w", ssh_FXF_WRITE),
+		testPacket(ssh_FXP_WRITE, binp.Out().B32(8).B32String("f3").B64(0).B32String("hello ")),
+		testPacket(ssh_FXP_WRITE, binp.Out().B32(9).B32String("f3").B64(6).B32String("world")),
+		testPacket(ssh_FXP_WRITE, binp.Out().B32(10).B32String("f3").B64(0).B32String("x")))
+	if len(rs) != 10 {
+		t.Fatalf("Got %d replies, expected 10", len(rs))
+	}
+	data := func(id uint32, s string) []byte {
+		return binp.Out().Byte(ssh_FXP_DATA).B32(id).B32String(s).Out()
+	}
+	if !bytes.Equal(rs[1], data(2, "hello")) || !bytes.Equal(rs[2], data(3, " world")) {
+		t.Fatalf("Invalid sequential reads: %X %X", rs[1], rs[2])
+	}
+	for i, code := range map[int]uint32{3: ssh_FX_EOF, 5: ssh_FX_OP_UNSUPPORTED, 7: ssh_FX_OK, 8: ssh_FX_OK, 9: ssh_FX_OP_UNSUPPORTED} {
+		if rs[i][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[i][5:]) != code {
+			t.Fatalf("Invalid reply %d, expected status %d: %X", i, code, rs[i])
+		}
+	}
+	if fs.written.String() != "hello world" {
+		t.Fatalf("Invalid sequential writes: %q", fs.written.String())
+	}
+}
+
+type sequentialFS struct {
+	EmptyFS
+	written bytes.Buffer
+}
+
+func (fs *sequentialFS) OpenFile(path string, flags uint32, a *Attr) (File, error) {
+	if path == "/w" {
+		return NewSequentialFile(nopWriteCloser{&fs.written}), nil
+	}
+	return NewSequentialFile(ioutil.NopCloser(strings.NewReader("hello world"))), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestContextFileSystem(t *testing.T) {
+	for _, workers := range []int{1, 2} {
+		fs := &contextFS{ContextFileSystem: ContextAdapter(EmptyFS{})}
+		ctx := NewConnContext(context.Background(), testConn{user: "bob"}, &ssh.Permissions{Extensions: map[string]string{"root": "/home/bob"}})
+		sc := &scriptChannel{Reader: bytes.NewReader(bytes.Join([][]byte{
+			testPacket(ssh_FXP_STAT, binp.Out().B32(1).B32String("/f")),
+			testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/f").B32(ssh_FXF_READ).B32(0)),
+			testPacket(ssh_FXP_READ, binp.Out().B32(3).B32String("f1").B64(0).B32(10)),
+		}, nil))}
+		done := make(chan error, 1)
+		go func() {
+			done <- (&ServerOptions{Workers: workers}).ServeChannelContext(ctx, sc, fs)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Blocked read was not cancelled at the end of the channel with %d workers", workers)
+		}
+		if fs.stat != "bob /home/bob" {
+			t.Fatalf("Invalid context in Stat: %q", fs.stat)
+		}
+		if fs.readErr != context.Canceled {
+			t.Fatalf("Invalid error from a cancelled read: %v", fs.readErr)
+		}
+		// The reply to the cancelled read is sent before closing the channel.
+		rs := scriptReplies(sc)
+		if len(rs) != 3 || rs[2][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[2][1:]) != 3 {
+			t.Fatalf("Invalid replies with %d workers: %X", workers, rs)
+		}
+	}
+}
+
+type testConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c testConn) User() string { return c.user }
+
+type contextFS struct {
+	ContextFileSystem
+	stat    string
+	readErr error
+}
+
+func (fs *contextFS) Stat(ctx context.Context, name string, islstat bool) (*Attr, error) {
+	conn, _ := ConnMetadataFromContext(ctx)
+	perms, _ := PermissionsFromContext(ctx)
+	fs.stat = conn.User() + " " + perms.Extensions["root"]
+	return &Attr{}, nil
+}
+func (fs *contextFS) OpenFile(ctx context.Context, name string, flags uint32, attr *Attr) (ContextFile, error) {
+	return &contextFile{fs: fs}, nil
+}
+
+type contextFile struct {
+	ContextFile
+	fs *contextFS
+}
+
+func (f *contextFile) ReadAt(ctx context.Context, bs []byte, offset int64) (int, error) {
+	<-ctx.Done()
+	f.fs.readErr = ctx.Err()
+	return 0, ctx.Err()
+}
+func (f *contextFile) Close() error { return nil }
+
+func TestContextOptional(t *testing.T) {
+	fs := &ctxOptFS{ContextFileSystem: ContextAdapter(EmptyFS{})}
+	name := Extension{Name: "name@test", Data: "1", ContextHandler: func(ctx context.Context, cfs ContextFileSystem, h ContextHandles, payload []byte) ([]byte, error) {
+		var handle string
+		if e := binp.NewParser(payload).B32String(&handle).End(); e != nil {
+			return nil, e
+		}
+		f, ok := h.File(handle).(*ctxOptFile)
+		if cfs != fs || !ok {
+			return nil, Failure
+		}
+		conn, _ := ConnMetadataFromContext(ctx)
+		return []byte(conn.User() + " " + f.name), nil
+	}}
+	ctx := NewConnContext(context.Background(), testConn{user: "bob"}, nil)
+	sc := &scriptChannel{Reader: bytes.NewReader(bytes.Join([][]byte{
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/a").B32(ssh_FXF_READ).B32(0)),
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(2).B32String("/b").B32(ssh_FXF_WRITE).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("copy-data").
+			B32String("f1").B64(0).B64(0).B32String("f2").B64(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(4).B32String("name@test").B32String("f2")),
+	}, nil))}
+	(&ServerOptions{Extensions: []Extension{name}}).ServeChannelContext(ctx, sc, fs)
+	rs := scriptReplies(sc)
+	if len(rs) != 4 || rs[0][0] != ssh_FXP_HANDLE || rs[1][0] != ssh_FXP_HANDLE {
+		t.Fatalf("Invalid replies: %X", rs)
+	}
+	if binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_OK || strings.Join(fs.calls, ",") != "open bob /a,open bob /b,copy bob /a /b" {
+		t.Fatalf("Invalid context open and copy: %X %v", rs[2], fs.calls)
+	}
+	if !bytes.Equal(rs[3], []byte("\xC9\x00\x00\x00\x04bob /b")) {
+		t.Fatalf("Invalid context extension reply: %X", rs[3])
+	}
+}
+
+// ctxOptFS implements the context variants of optional interfaces
+// and records the calls with the user of the context.
+type ctxOptFS struct {
+	ContextFileSystem
+	calls []string
+}
+
+func (fs *ctxOptFS) record(ctx context.Context, call string) {
+	conn, _ := ConnMetadataFromContext(ctx)
+	fs.calls = append(fs.calls, strings.Replace(call, " ", " "+conn.User()+" ", 1))
+}
+
+func (fs *ctxOptFS) Open(ctx context.Context, r *OpenRequest) (ContextFile, error) {
+	fs.record(ctx, "open "+r.Path)
+	return &ctxOptFile{fs: fs, name: r.Path}, nil
+}
+
+type ctxOptFile struct {
+	ContextFile
+	fs   *ctxOptFS
+	name string
+}
+
+func (f *ctxOptFile) Close() error { return nil }
+func (f *ctxOptFile) CopyData(ctx context.Context, offset, length uint64, dst ContextFile, dstOffset uint64) error {
+	d, ok := dst.(*ctxOptFile)
+	if !ok {
+		return Failure
+	}
+	f.fs.record(ctx, "copy "+f.name+" "+d.name)
+	return nil
+}
+
+func TestSymlink(t *testing.T) {
+	os.Mkdir("/tmp/test-sftpd", 0700)
+	os.Remove("/tmp/test-sftpd/symlink")
+	runClientTest(t, rfs{}, func(cl *client.Client) error {
+		return cl.Symlink("symlink-target", "/symlink")
+	})
+	target, e := os.Readlink("/tmp/test-sftpd/symlink")
+	failOnErr(t, e, "Failed to read symlink")
+	if target != "symlink-target" {
+		t.Fatalf("Symlink points to %q", target)
+	}
+}
+
+func TestExtended(t *testing.T) {
+	echo := Extension{Name: "echo@test", Data: "1", Handler: func(fs FileSystem, h Handles, payload []byte) ([]byte, error) {
+		return append([]byte("echo:"), payload...), nil
+	}}
+	rs := serveScriptOptions(&ServerOptions{Extensions: []Extension{echo}}, EmptyFS{},
+		testPacket(ssh_FXP_INIT, binp.Out().B32(3)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(1).B32String("echo@test").B32String("x")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("nonexistent@test")))
+	if len(rs) != 3 {
+		t.Fatalf("Got %d replies, expected 3", len(rs))
+	}
+	if rs[0][0] != ssh_FXP_VERSION || !bytes.Contains(rs[0], []byte("\x00\x00\x00\x09echo@test\x00\x00\x00\x011")) {
+		t.Fatalf("Extension not advertised in version reply: %X", rs[0])
+	}
+	if !bytes.Equal(rs[1], []byte("\xC9\x00\x00\x00\x01echo:\x00\x00\x00\x01x")) {
+		t.Fatalf("Invalid extended reply: %X", rs[1])
+	}
+	if rs[2][0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_OP_UNSUPPORTED {
+		t.Fatalf("Unknown extension not reported as unsupported: %X", rs[2])
+	}
+
+	// Extensions are per server and can resolve handles.
+	rs = serveScript(EmptyFS{}, testPacket(ssh_FXP_INIT, binp.Out().B32(3)))
+	if len(rs) != 1 || bytes.Contains(rs[0], []byte("echo@test")) {
+		t.Fatalf("Extension advertised without being configured: %X", rs)
+	}
+	isFile := Extension{Name: "is-file@test", Data: "1", Handler: func(fs FileSystem, h Handles, payload []byte) ([]byte, error) {
+		var handle string
+		if e := binp.NewParser(payload).B32String(&handle).End(); e != nil {
+			return nil, e
+		}
+		if h.File(handle) == nil {
+			return nil, errInvalidHandle
+		}
+		return nil, nil
+	}}
+	rs = serveScriptOptions(&ServerOptions{Extensions: []Extension{isFile}}, &syncFS{},
+		testPacket(ssh_FXP_OPEN, binp.Out().B32(1).B32String("/f").B32(0).B32(0)),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(2).B32String("is-file@test").B32String("f1")),
+		testPacket(ssh_FXP_EXTENDED, binp.Out().B32(3).B32String("is-file@test").B32String("f2")))
+	if len(rs) != 3 || binary.BigEndian.Uint32(rs[1][5:]) != ssh_FX_OK || binary.BigEndian.Uint32(rs[2][5:]) != ssh_FX_FAILURE {
+		t.Fatalf("Invalid replies of a handle extension: %X", rs)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	rs := serveScript(EmptyFS{},
+		testPacket(99, binp.Out().B32(7).B32String("junk")),
+		testPacket(ssh_FXP_VERSION, binp.Out().B32(8)))
+	if len(rs) != 2 {
+		t.Fatalf("Got %d replies, expected 2", len(rs))
+	}
+	for i, r := range rs {
+		if r[0] != ssh_FXP_STATUS || binary.BigEndian.Uint32(r[1:]) != uint32(7+i) || binary.BigEndian.Uint32(r[5:]) != ssh_FX_OP_UNSUPPORTED {
+			t.Fatalf("Invalid reply to unknown packet: %X", r)
+		}
+	}
+}
+
 func TestRandomInput(t *testing.T) {
 	fs := EmptyFS{}
 	rd := &fakeRandChannel{}
@@ -203,6 +1632,118 @@ func (*fakeRandChannel) SendRequest(name string, wantReply bool, payload []byte)
 }
 func (fr *fakeRandChannel) Stderr() io.ReadWriter { return fr }
 
+// BenchmarkRead measures downloading a file from memory with requests
+// pipelined like OpenSSH does.
+func BenchmarkRead(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkRead(b, workers, 32*1024)
+		})
+	}
+	b.Run("length=256KiB", func(b *testing.B) {
+		benchmarkRead(b, 1, 256*1024)
+	})
+}
+
+func benchmarkRead(b *testing.B, workers int, length uint32) {
+	const size = 16 << 20
+	fs := memFS{files: map[string]*memFile{"/f": {bs: make([]byte, size)}}}
+	packets := [][]byte{testPacket(ssh_FXP_OPEN, binp.Out().B32(0).B32String("/f").B32(ssh_FXF_READ).B32(0))}
+	for off := uint32(0); off < size; off += length {
+		packets = append(packets, testPacket(ssh_FXP_READ, binp.Out().B32(off/length).B32String("f1").B64(uint64(off)).B32(length)))
+	}
+	script := bytes.Join(packets, nil)
+	o := &ServerOptions{Workers: workers, MaxReadLength: length}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dc := &discardChannel{scriptChannel: scriptChannel{Reader: bytes.NewReader(script)}}
+		o.ServeChannel(dc, fs)
+		if dc.n < size {
+			b.Fatalf("Read %d bytes, expected %d", dc.n, size)
+		}
+	}
+}
+
+// discardChannel counts the bytes written instead of storing them.
+type discardChannel struct {
+	scriptChannel
+	n int
+}
+
+func (dc *discardChannel) Write(bs []byte) (int, error) {
+	dc.n += len(bs)
+	return len(bs), nil
+}
+
+// scriptChannel feeds a fixed input to ServeChannel and records the output.
+type scriptChannel struct {
+	*bytes.Reader
+	mu     sync.Mutex
+	out    bytes.Buffer
+	closed bool
+}
+
+func (sc *scriptChannel) Write(bs []byte) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return sc.out.Write(bs)
+}
+func (sc *scriptChannel) Close() error {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.mu.Unlock()
+	return nil
+}
+func (*scriptChannel) CloseWrite() error { return nil }
+func (*scriptChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+func (sc *scriptChannel) Stderr() io.ReadWriter { return &sc.out }
+
+func testPacket(op byte, o *binp.Printer) []byte {
+	bs := o.Out()
+	return append(binp.Out().B32(uint32(1+len(bs))).Byte(op).Out(), bs...)
+}
+
+// serveScript serves the given packets and returns the reply packets
+// without their length prefix.
+func serveScript(fs FileSystem, packets ...[]byte) [][]byte {
+	return serveScriptOptions(nil, fs, packets...)
+}
+
+// serveScriptActivity serves packets with requests tracked by act.
+func serveScriptActivity(act *activity, packets ...[]byte) [][]byte {
+	sc := &scriptChannel{Reader: bytes.NewReader(bytes.Join(packets, nil))}
+	ServeChannelContext(withActivity(context.Background(), act), sc, ContextAdapter(&attrFS{}))
+	return scriptReplies(sc)
+}
+
+func serveScriptOptions(o *ServerOptions, fs FileSystem, packets ...[]byte) [][]byte {
+	sc := &scriptChannel{Reader: bytes.NewReader(bytes.Join(packets, nil))}
+	o.ServeChannel(sc, fs)
+	return scriptReplies(sc)
+}
+
+// scriptReplies returns the reply packets written to sc.
+func scriptReplies(sc *scriptChannel) [][]byte {
+	var rs [][]byte
+	bs := sc.out.Bytes()
+	for len(bs) >= 4 {
+		n := int(binary.BigEndian.Uint32(bs))
+		if n > len(bs)-4 {
+			break
+		}
+		rs = append(rs, bs[4:4+n])
+		bs = bs[4+n:]
+	}
+	return rs
+}
+
 type rfile struct {
 	EmptyFile
 	f *os.File
@@ -294,3 +1835,62 @@ func (fs rfs) Stat(name string, islstat bool) (*Attr, error) {
 
 	return &a, nil
 }
+
+func (fs rfs) Rename(oldpath, newpath string, flags uint32) error {
+	op, e := rfsMangle(oldpath)
+	if e != nil {
+		return e
+	}
+	np, e := rfsMangle(newpath)
+	if e != nil {
+		return e
+	}
+	// Plain SFTP renames must not overwrite an existing file.
+	if _, e := os.Lstat(np); e == nil && flags&RENAME_OVERWRITE == 0 {
+		return os.ErrExist
+	}
+	return os.Rename(op, np)
+}
+
+func (fs rfs) CreateLink(path string, target string, flags uint32) error {
+	p, e := rfsMangle(path)
+	if e != nil {
+		return e
+	}
+	if flags == LINK_HARD {
+		tp, e := rfsMangle(target)
+		if e != nil {
+			return e
+		}
+		return os.Link(tp, p)
+	}
+	return os.Symlink(target, p)
+}
+
+type memFS struct {
+	EmptyFS
+	files map[string]*memFile
+}
+
+func (fs memFS) OpenFile(path string, flags uint32, a *Attr) (File, error) {
+	f, ok := fs.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+type memFile struct {
+	EmptyFile
+	bs []byte
+}
+
+func (f *memFile) ReadAt(bs []byte, offset int64) (int, error) {
+	return bytes.NewReader(f.bs).ReadAt(bs, offset)
+}
+func (f *memFile) WriteAt(bs []byte, offset int64) (int, error) {
+	if end := int(offset) + len(bs); end > len(f.bs) {
+		f.bs = append(f.bs, make([]byte, end-len(f.bs))...)
+	}
+	return copy(f.bs[offset:], bs), nil
+}
@@ -0,0 +1,91 @@
+package sftpd
+
+import (
+	"io"
+	"os"
+	"strconv"
+)
+
+// StatusError is an error carrying a SFTP status code. FileSystems can
+// return it to send a specific code to the client. Codes that the
+// negotiated protocol version does not define are sent as STATUS_FAILURE.
+type StatusError uint32
+
+// Status codes that can be returned as a StatusError.
+const (
+	STATUS_FAILURE                     = StatusError(ssh_FX_FAILURE)
+	STATUS_INVALID_HANDLE              = StatusError(ssh_FX_INVALID_HANDLE)
+	STATUS_NO_SUCH_PATH                = StatusError(ssh_FX_NO_SUCH_PATH)
+	STATUS_FILE_ALREADY_EXISTS         = StatusError(ssh_FX_FILE_ALREADY_EXISTS)
+	STATUS_WRITE_PROTECT               = StatusError(ssh_FX_WRITE_PROTECT)
+	STATUS_NO_MEDIA                    = StatusError(ssh_FX_NO_MEDIA)
+	STATUS_NO_SPACE_ON_FILESYSTEM      = StatusError(ssh_FX_NO_SPACE_ON_FILESYSTEM)
+	STATUS_QUOTA_EXCEEDED              = StatusError(ssh_FX_QUOTA_EXCEEDED)
+	STATUS_UNKNOWN_PRINCIPAL           = StatusError(ssh_FX_UNKNOWN_PRINCIPAL)
+	STATUS_LOCK_CONFLICT               = StatusError(ssh_FX_LOCK_CONFLICT)
+	STATUS_DIR_NOT_EMPTY               = StatusError(ssh_FX_DIR_NOT_EMPTY)
+	STATUS_NOT_A_DIRECTORY             = StatusError(ssh_FX_NOT_A_DIRECTORY)
+	STATUS_INVALID_FILENAME            = StatusError(ssh_FX_INVALID_FILENAME)
+	STATUS_LINK_LOOP                   = StatusError(ssh_FX_LINK_LOOP)
+	STATUS_CANNOT_DELETE               = StatusError(ssh_FX_CANNOT_DELETE)
+	STATUS_INVALID_PARAMETER           = StatusError(ssh_FX_INVALID_PARAMETER)
+	STATUS_FILE_IS_A_DIRECTORY         = StatusError(ssh_FX_FILE_IS_A_DIRECTORY)
+	STATUS_BYTE_RANGE_LOCK_CONFLICT    = StatusError(ssh_FX_BYTE_RANGE_LOCK_CONFLICT)
+	STATUS_BYTE_RANGE_LOCK_REFUSED     = StatusError(ssh_FX_BYTE_RANGE_LOCK_REFUSED)
+	STATUS_DELETE_PENDING              = StatusError(ssh_FX_DELETE_PENDING)
+	STATUS_FILE_CORRUPT                = StatusError(ssh_FX_FILE_CORRUPT)
+	STATUS_OWNER_INVALID               = StatusError(ssh_FX_OWNER_INVALID)
+	STATUS_GROUP_INVALID               = StatusError(ssh_FX_GROUP_INVALID)
+	STATUS_NO_MATCHING_BYTE_RANGE_LOCK = StatusError(ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK)
+)
+
+func (e StatusError) Error() string {
+	return "sftp status " + strconv.Itoa(int(e))
+}
+
+// statusCode maps an error to the status code sent to a client
+// speaking the given protocol version.
+func statusCode(err error, version uint32) ssh_fx {
+	var code ssh_fx
+	switch e := err.(type) {
+	case nil:
+		return ssh_FX_OK
+	case StatusError:
+		code = ssh_fx(e)
+	default:
+		switch {
+		case err == io.EOF:
+			return ssh_FX_EOF
+		case err == ErrUnsupported, err == ErrNotSequential:
+			return ssh_FX_OP_UNSUPPORTED
+		case err == errInvalidHandle:
+			code = ssh_FX_INVALID_HANDLE
+		case os.IsPermission(err):
+			return ssh_FX_PERMISSION_DENIED
+		case os.IsNotExist(err):
+			return ssh_FX_NO_SUCH_FILE
+		case os.IsExist(err):
+			code = ssh_FX_FILE_ALREADY_EXISTS
+		default:
+			return ssh_FX_FAILURE
+		}
+	}
+	if code > maxStatusCode(version) {
+		code = ssh_FX_FAILURE
+	}
+	return code
+}
+
+// maxStatusCode returns the highest status code defined by
+// a protocol version.
+func maxStatusCode(version uint32) ssh_fx {
+	switch version {
+	case 3:
+		return ssh_FX_OP_UNSUPPORTED
+	case 4:
+		return ssh_FX_NO_MEDIA
+	case 5:
+		return ssh_FX_LOCK_CONFLICT
+	}
+	return ssh_FX_NO_MATCHING_BYTE_RANGE_LOCK
+}
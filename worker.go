@@ -0,0 +1,140 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+
+	"github.com/taruti/bytepool"
+	"golang.org/x/crypto/ssh"
+)
+
+// lockedChannel serializes the replies written by concurrent workers.
+type lockedChannel struct {
+	ssh.Channel
+	mu sync.Mutex
+}
+
+func (c *lockedChannel) Write(bs []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Channel.Write(bs)
+}
+
+// request is a packet queued for a worker. The data is allocated
+// from bytepool and freed by the worker.
+type request struct {
+	op byte
+	bs []byte
+}
+
+// workers serves requests of a session concurrently. Requests are
+// assigned to workers by their first string, a handle or a path, so
+// requests for the same handle are served by the same worker in order.
+type workers struct {
+	s      *session
+	c      ssh.Channel
+	queues []chan request
+	next   int
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+}
+
+// workerQueueLength is the number of requests queued per worker before
+// reading from the channel blocks.
+const workerQueueLength = 16
+
+func newWorkers(s *session, c ssh.Channel) *workers {
+	w := &workers{s: s, c: c, queues: make([]chan request, s.opts.Workers)}
+	for i := range w.queues {
+		w.queues[i] = make(chan request, workerQueueLength)
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+	return w
+}
+
+func (w *workers) run(q chan request) {
+	defer w.wg.Done()
+	for r := range q {
+		if w.error() == nil {
+			e := w.s.serveRequest(w.c, r.op, r.bs)
+			if e != nil {
+				w.fail(e)
+			}
+		}
+		w.s.act.end()
+		bytepool.Free(r.bs)
+	}
+}
+
+// fail records the first error ending the session and closes the
+// channel to stop reading further requests.
+func (w *workers) fail(e error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = e
+		w.c.Close()
+	}
+	w.mu.Unlock()
+}
+
+func (w *workers) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// dispatch queues a copy of a request packet.
+func (w *workers) dispatch(op byte, bs []byte) {
+	r := request{op: op, bs: bytepool.Alloc(len(bs))}
+	copy(r.bs, bs)
+	w.queues[w.queue(op, bs)] <- r
+}
+
+func (w *workers) queue(op byte, bs []byte) int {
+	key, ok := requestKey(op, bs)
+	if !ok {
+		w.next = (w.next + 1) % len(w.queues)
+		return w.next
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(w.queues)))
+}
+
+// wait stops the workers after the queued requests are served and
+// returns the first error ending the session.
+func (w *workers) wait() error {
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+	return w.err
+}
+
+// requestKey returns the first string argument of a request following
+// the request id. For SSH_FXP_EXTENDED the extension name is skipped.
+func requestKey(op byte, bs []byte) ([]byte, bool) {
+	if len(bs) < 4 {
+		return nil, false
+	}
+	key, rest, ok := nextString(bs[4:])
+	if ok && op == ssh_FXP_EXTENDED {
+		key, _, ok = nextString(rest)
+	}
+	return key, ok
+}
+
+// nextString splits the string at the start of bs from the rest.
+func nextString(bs []byte) ([]byte, []byte, bool) {
+	if len(bs) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(bs)
+	if uint64(n) > uint64(len(bs)-4) {
+		return nil, nil, false
+	}
+	return bs[4 : 4+n], bs[4+n:], true
+}